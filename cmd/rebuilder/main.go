@@ -3,18 +3,23 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/BurntSushi/toml"
 	"github.com/FogMeta/rebuilder-tools/rebuilder"
 	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
 	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/s3"
 	"github.com/urfave/cli/v2"
 )
 
@@ -32,7 +37,18 @@ func main() {
 		Usage:    "A tool to rebuild file",
 	}
 
-	if err := app.Run(os.Args); err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		// restore the default behavior, so the next signal exits at once
+		signal.Stop(sigs)
+		log.Warnf("received %s, cleaning up, interrupt again to exit at once", sig)
+		cancel()
+	}()
+	if err := app.RunContext(ctx, os.Args); err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
@@ -102,6 +118,38 @@ var buildCmd = &cli.Command{
 			Name:  "save-path",
 			Usage: "retrieved file save directory",
 		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "build even if disk space check failed",
+		},
+		&cli.BoolFlag{
+			Name:  "streaming",
+			Usage: "restore each car as soon as it is downloaded",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-verify",
+			Usage: "upload without verifying the rebuilt files reproduce the payload cids",
+		},
+		&cli.StringFlag{
+			Name:  "manifest",
+			Usage: "write the manifest of the uploaded files to the json/csv file instead of printing a table",
+		},
+		&cli.StringFlag{
+			Name:  "path",
+			Usage: "path inside the dataset to rebuild only, like sub/dir/file.bin",
+		},
+		&cli.StringFlag{
+			Name:  "graph-manifest",
+			Usage: "graphsplit manifest.csv to select the cars and retrieval paths of --path",
+		},
+		&cli.StringFlag{
+			Name:  "car-dir",
+			Usage: "build from the local car files in the directory",
+		},
+		&cli.StringSliceFlag{
+			Name:  "gateway",
+			Usage: "ipfs trustless gateway urls, tried by payload cid when car urls failed",
+		},
 	},
 	Action: func(ctx *cli.Context) (err error) {
 		confPath := ctx.String("conf")
@@ -111,24 +159,42 @@ var buildCmd = &cli.Command{
 		if confPath == "" {
 			return errors.New("need run init before build")
 		}
+		if err = checkManifestPath(ctx.String("manifest")); err != nil {
+			return err
+		}
 		filePath := ctx.String("file")
+		carDir := ctx.String("car-dir")
 		carURLs := ctx.Args().Slice()
-		if filePath == "" && len(carURLs) == 0 {
-			return errors.New("file or download urls is required")
+		if filePath == "" && carDir == "" && len(carURLs) == 0 {
+			return errors.New("file, car dir or download urls is required")
 		}
-		var carInfos []*rebuilder.CarInfo
+		var buildInfos []*rebuilder.CarInfo
+		for _, carURL := range carURLs {
+			buildInfos = append(buildInfos, &rebuilder.CarInfo{CarFileUrl: carURL})
+		}
+		if carDir != "" {
+			localInfos, err := rebuilder.LocalCars(carDir)
+			if err != nil {
+				return err
+			}
+			buildInfos = append(buildInfos, localInfos...)
+		}
+		// cars with only payload cid are downloaded from the ipfs gateways
+		var carInfos, cidInfos []*rebuilder.CarInfo
 		if filePath != "" {
 			carInfos, err = readCarFile(filePath)
 			if err != nil {
 				return err
 			}
 			for _, info := range carInfos {
-				if info.CarFileUrl != "" {
-					carURLs = append(carURLs, info.CarFileUrl)
+				if len(info.URLs()) > 0 {
+					buildInfos = append(buildInfos, info)
+				} else {
+					cidInfos = append(cidInfos, info)
 				}
 			}
 		}
-		if len(carURLs) == 0 {
+		if len(buildInfos) == 0 && len(cidInfos) == 0 {
 			return errors.New("no valid car urls")
 		}
 		log.Info("rebuild start ...")
@@ -139,37 +205,90 @@ var buildCmd = &cli.Command{
 		}
 		lotusNode := ctx.String("lotus-node")
 		timeout := ctx.Int("timeout")
+		wallet := ctx.String("wallet")
+		// [lotus] is optional for build, only set by the flags
+		if conf.Lotus == nil && (lotusNode != "" || timeout > 0 || wallet != "") {
+			conf.Lotus = new(config.Lotus)
+		}
 		if lotusNode != "" {
 			conf.Lotus.NodeApi = lotusNode
 		}
 		if timeout > 0 {
 			conf.Lotus.Timeout = timeout
 		}
+		if wallet != "" {
+			conf.Lotus.Wallet = wallet
+		}
+		if ctx.Bool("force") {
+			conf.Task.Force = true
+		}
+		if ctx.Bool("streaming") {
+			conf.Task.Streaming = true
+		}
+		if ctx.Bool("skip-verify") {
+			conf.Task.SkipVerify = true
+		}
+		if dataPath := ctx.String("path"); dataPath != "" {
+			conf.Task.Path = dataPath
+		}
+		if graphManifest := ctx.String("graph-manifest"); graphManifest != "" {
+			conf.Task.GraphManifest = graphManifest
+		}
+		if carDir != "" && filePath == "" && len(carURLs) == 0 && conf.Task.Source == "" {
+			// only local cars, no download
+			conf.Task.Source = rebuilder.SourceLocal
+		}
+		if gateways := ctx.StringSlice("gateway"); len(gateways) > 0 {
+			conf.Gateway = &config.Gateway{URLs: gateways}
+		}
+		if len(cidInfos) > 0 {
+			if conf.Gateway == nil || len(conf.Gateway.URLs) == 0 {
+				return fmt.Errorf("car %s has no url, set gateway to download it by payload cid", cidInfos[0].CID)
+			}
+			buildInfos = append(buildInfos, rebuilder.GatewayCars(cidInfos)...)
+		}
 		// init rebuilder
-		rebuilder, err := rebuilder.NewRebuilder(conf)
+		builder, err := rebuilder.NewRebuilder(conf)
 		if err != nil {
 			return err
 		}
-		fileURL, err := rebuilder.Build(ctx.String("name"), carURLs...)
+		defer builder.Close()
+		builder.OnProgress(printProgress)
+		manifest, err := builder.BuildCars(ctx.Context, ctx.String("name"), buildInfos)
 		if err != nil {
 			log.Info("build from car url failed", err)
+			if ctx.Context.Err() != nil {
+				return err
+			}
+			if conf.Gateway != nil && len(conf.Gateway.URLs) > 0 && len(rebuilder.GatewayCars(carInfos)) > 0 {
+				log.Info("try download from ipfs gateway")
+				manifest, err = builder.BuildFrom(ctx.Context, rebuilder.SourceGateway, ctx.String("name"), carInfos)
+				if err == nil {
+					log.Info("rebuild file success")
+					return outputManifest(manifest, ctx.String("manifest"))
+				}
+				log.Info("build from ipfs gateway failed", err)
+				if ctx.Context.Err() != nil {
+					return err
+				}
+			}
 			if len(carInfos) > 0 && len(carInfos[0].Deals) > 0 {
 				log.Info("try retrieve from deal")
 				name := ctx.String("name")
 				if name == "" {
 					name = filepath.Base(filePath)
 				}
-				fileURL, err = rebuilder.Retrieve(name, carInfos, ctx.String("wallet"))
+				manifest, err = builder.BuildFrom(ctx.Context, rebuilder.SourceRetrieve, name, carInfos)
 				if err != nil {
 					return
 				}
-				log.Info("rebuild file success, download url :", fileURL)
-				return
+				log.Info("rebuild file success")
+				return outputManifest(manifest, ctx.String("manifest"))
 			}
 			return err
 		}
-		log.Info("rebuild file success, download url :", fileURL)
-		return nil
+		log.Info("rebuild file success")
+		return outputManifest(manifest, ctx.String("manifest"))
 	},
 }
 
@@ -214,8 +333,27 @@ var retrieveCmd = &cli.Command{
 			Name:  "conf",
 			Usage: "conf file path",
 		},
+		&cli.BoolFlag{
+			Name:  "skip-verify",
+			Usage: "upload without verifying the rebuilt files reproduce the payload cids",
+		},
+		&cli.StringFlag{
+			Name:  "manifest",
+			Usage: "write the manifest of the uploaded files to the json/csv file instead of printing a table",
+		},
+		&cli.StringFlag{
+			Name:  "path",
+			Usage: "path inside the dataset to rebuild only, like sub/dir/file.bin",
+		},
+		&cli.StringFlag{
+			Name:  "graph-manifest",
+			Usage: "graphsplit manifest.csv to select the cars and retrieval paths of --path",
+		},
 	},
 	Action: func(ctx *cli.Context) (err error) {
+		if err = checkManifestPath(ctx.String("manifest")); err != nil {
+			return err
+		}
 		var carInfos []*rebuilder.CarInfo
 		if filePath := ctx.String("file"); filePath != "" {
 			// read from file
@@ -269,6 +407,9 @@ var retrieveCmd = &cli.Command{
 			return err
 		}
 
+		if conf.Lotus == nil {
+			conf.Lotus = new(config.Lotus)
+		}
 		// check wallet
 		if conf.Lotus.Wallet == "" && ctx.String("wallet") == "" {
 			return errors.New("wallet is required")
@@ -281,28 +422,131 @@ var retrieveCmd = &cli.Command{
 		if timeout > 0 {
 			conf.Lotus.Timeout = timeout
 		}
+		if wallet := ctx.String("wallet"); wallet != "" {
+			conf.Lotus.Wallet = wallet
+		}
+		if savePath := ctx.String("save-path"); savePath != "" {
+			conf.Task.OutputPath = savePath
+		}
+		if ctx.Bool("skip-verify") {
+			conf.Task.SkipVerify = true
+		}
+		if dataPath := ctx.String("path"); dataPath != "" {
+			conf.Task.Path = dataPath
+		}
+		if graphManifest := ctx.String("graph-manifest"); graphManifest != "" {
+			conf.Task.GraphManifest = graphManifest
+		}
 		// init rebuilder
 		builder, err := rebuilder.NewRebuilder(conf)
 		if err != nil {
 			return err
 		}
+		defer builder.Close()
+		builder.OnProgress(printProgress)
 
 		name := ctx.String("name")
 		if name == "" {
 			name = carInfos[0].CID
 		}
 
-		downloadURL, err := builder.Retrieve(name, carInfos, ctx.String("wallet"), ctx.String("save-path"))
+		manifest, err := builder.BuildFrom(ctx.Context, rebuilder.SourceRetrieve, name, carInfos)
 		if err != nil {
 			return err
 		}
-		log.Info("retrieve success, file download url: ", downloadURL)
-		return nil
+		log.Info("retrieve success")
+		return outputManifest(manifest, ctx.String("manifest"))
 	},
 }
 
-func httpDownloadURL(url string) bool {
-	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+// outputManifest writes the manifest to the json/csv file at path, or prints it as a table if path is empty
+func outputManifest(manifest *rebuilder.Manifest, path string) (err error) {
+	if path == "" {
+		return manifest.WriteTable(os.Stdout)
+	}
+	if err = checkManifestPath(path); err != nil {
+		return
+	}
+	write := manifest.WriteJSON
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		write = manifest.WriteCSV
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	if err = write(f); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	log.Infof("manifest of %d files saved to %s", len(manifest.Files), path)
+	return
+}
+
+// checkManifestPath checks the manifest file is json or csv before the build
+func checkManifestPath(path string) error {
+	format := filepath.Ext(path)
+	if path == "" || strings.EqualFold(format, ".csv") || strings.EqualFold(format, ".json") {
+		return nil
+	}
+	return errors.New("not supported manifest format :" + format)
+}
+
+func printProgress(p rebuilder.Progress) {
+	if p.Finished {
+		if p.Err != nil {
+			fmt.Printf("[%s] failed %s: %v\n", p.Stage, p.Job, p.Err)
+		} else {
+			fmt.Printf("[%s] done %s\n", p.Stage, p.Job)
+		}
+		return
+	}
+	if p.Done == 0 && p.Total == 0 {
+		fmt.Printf("[%s] start %s\n", p.Stage, p.Job)
+		return
+	}
+	percent := "-"
+	if p.Total > 0 {
+		percent = fmt.Sprintf("%.2f%%", p.Percent())
+	}
+	eta := "-"
+	if p.ETA > 0 {
+		eta = p.ETA.String()
+	}
+	fmt.Printf("[%s] %s %s/%s %s/s ETA %s %s\n", p.Stage, percent, formatBytes(p.Done), formatBytes(p.Total), formatBytes(p.Speed), eta, p.Job)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func validDownloadURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") || strings.HasPrefix(url, s3.Scheme) ||
+		strings.HasPrefix(url, "file://")
+}
+
+// carKey returns the key merging the rows of the same car, the car url, or the payload cid
+// if the car has no url and is downloaded from the ipfs gateways
+func carKey(carURL, payloadCid string) (string, error) {
+	if carURL == "" && payloadCid != "" {
+		return "ipfs://" + payloadCid, nil
+	}
+	if !validDownloadURL(carURL) {
+		return "", errors.New("invalid download URL")
+	}
+	return carURL, nil
 }
 
 func readCarFile(path string) (carInfos []*rebuilder.CarInfo, err error) {
@@ -326,17 +570,28 @@ func readCarJson(filepath string) (carInfos []*rebuilder.CarInfo, err error) {
 	}
 	m := make(map[string]*rebuilder.CarInfo)
 	for _, cj := range list {
-		if !httpDownloadURL(cj.CarFileUrl) {
-			return nil, errors.New("invalid download URL")
+		var key string
+		if key, err = carKey(cj.CarFileUrl, cj.CID); err != nil {
+			return
+		}
+		for _, mirror := range cj.Mirrors {
+			if !validDownloadURL(mirror) {
+				return nil, errors.New("invalid mirror URL")
+			}
 		}
-		if _, ok := m[cj.CarFileUrl]; !ok {
+		if _, ok := m[key]; !ok {
 			info := &rebuilder.CarInfo{
-				CarFileUrl: cj.CarFileUrl,
+				CarFileUrl:    cj.CarFileUrl,
+				CarFileSize:   cj.CarFileSize,
+				CarFileSha256: cj.CarFileSha256,
+				PieceCid:      cj.PieceCid,
+				CID:           cj.CID,
 			}
 			carInfos = append(carInfos, info)
-			m[cj.CarFileUrl] = info
+			m[key] = info
 		}
-		info := m[cj.CarFileUrl]
+		info := m[key]
+		info.Mirrors = append(info.Mirrors, cj.Mirrors...)
 		info.Deals = append(info.Deals, cj.Deals...)
 	}
 	return
@@ -345,6 +600,10 @@ func readCarJson(filepath string) (carInfos []*rebuilder.CarInfo, err error) {
 const (
 	filedCarFileURL = "car_file_url"
 	fieldCarDeals   = "deals"
+	fieldMirrors    = "mirrors"
+	fieldCarSize    = "car_file_size"
+	fieldCarSha256  = "car_file_sha256"
+	fieldPieceCid   = "piece_cid"
 	filedPayloadCid = "pay_load_cid"
 )
 
@@ -366,20 +625,46 @@ func readCarCsv(filepath string) (carInfos []*rebuilder.CarInfo, err error) {
 			continue
 		}
 		carURL := fields[colMap[filedCarFileURL]]
-		if !httpDownloadURL(carURL) {
-			return nil, errors.New("invalid download URL")
+		var payloadCid string
+		if col, ok := colMap[filedPayloadCid]; ok {
+			payloadCid = fields[col]
+		}
+		var key string
+		if key, err = carKey(carURL, payloadCid); err != nil {
+			return
 		}
 
-		if _, ok := m[carURL]; !ok {
+		if _, ok := m[key]; !ok {
 			info := &rebuilder.CarInfo{
 				CarFileUrl: carURL,
 			}
 			carInfos = append(carInfos, info)
-			m[carURL] = info
+			m[key] = info
 		}
-		info := m[carURL]
-		if col, ok := colMap[filedPayloadCid]; ok {
-			info.CID = fields[col]
+		info := m[key]
+		info.CID = payloadCid
+		if col, ok := colMap[fieldCarSize]; ok && fields[col] != "" {
+			if info.CarFileSize, err = strconv.ParseInt(fields[col], 10, 64); err != nil {
+				return
+			}
+		}
+		if col, ok := colMap[fieldCarSha256]; ok {
+			info.CarFileSha256 = fields[col]
+		}
+		if col, ok := colMap[fieldPieceCid]; ok {
+			info.PieceCid = fields[col]
+		}
+		if col, ok := colMap[fieldMirrors]; ok && fields[col] != "" {
+			var mirrors []string
+			if err = json.Unmarshal([]byte(fields[col]), &mirrors); err != nil {
+				return
+			}
+			for _, mirror := range mirrors {
+				if !validDownloadURL(mirror) {
+					return nil, errors.New("invalid mirror URL")
+				}
+			}
+			info.Mirrors = append(info.Mirrors, mirrors...)
 		}
 		if col, ok := colMap[fieldCarDeals]; ok && fields[col] != "" {
 			var deals []*rebuilder.CarDeal
@@ -3,14 +3,17 @@ package aria2
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +21,14 @@ const (
 	aria2AddURI = "aria2.addUri"
 	aria2Status = "aria2.tellStatus"
 
+	SchemeHttp  = "http"
+	SchemeHttps = "https"
+	SchemeWs    = "ws"
+	SchemeWss   = "wss"
+
+	defaultPort = 6800
+	defaultPath = "/jsonrpc"
+
 	contentTypeJson = "application/json; charset=UTF-8"
 	contentTypeForm = "application/x-www-form-urlencoded"
 )
@@ -27,11 +38,21 @@ const (
 	StatusWaiting  string = "waiting"
 	StatusActive   string = "active"
 	StatusComplete string = "complete"
+	StatusPaused   string = "paused"
+	StatusRemoved  string = "removed"
 )
 
 type Client struct {
-	token     string
-	serverUrl string
+	token      string
+	serverUrl  string
+	httpClient *http.Client
+	wsUrl      string
+	tlsConfig  *tls.Config
+	mu         sync.Mutex
+	ws         *wsConn                        // redialed with backoff once closed
+	subs       map[chan Notification]struct{} // nil without websocket
+	done       chan struct{}
+	closeOnce  sync.Once
 }
 
 type StatusResp struct {
@@ -49,8 +70,16 @@ type Payload struct {
 }
 
 type DownloadOption struct {
-	Out string `json:"out"`
-	Dir string `json:"dir"`
+	Out                    string   `json:"out"`
+	Dir                    string   `json:"dir"`
+	MaxDownloadLimit       string   `json:"max-download-limit,omitempty"`
+	Split                  string   `json:"split,omitempty"`
+	MaxConnectionPerServer string   `json:"max-connection-per-server,omitempty"`
+	Header                 []string `json:"header,omitempty"`
+	UserAgent              string   `json:"user-agent,omitempty"`
+	Checksum               string   `json:"checksum,omitempty"`
+	Continue               string   `json:"continue,omitempty"`
+	AllProxy               string   `json:"all-proxy,omitempty"`
 }
 
 type DownloadResp struct {
@@ -65,6 +94,17 @@ type Error struct {
 	Message string `json:"message"`
 }
 
+// DownloadError is the error of a download stopped by aria2, Code is the aria2 exit status
+type DownloadError struct {
+	Gid     string
+	Code    int
+	Message string
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("download gid: %s, error code: %d, %s", e.Gid, e.Code, e.Message)
+}
+
 type StatusResult struct {
 	BitField        string                  `json:"bitfield"`
 	CompletedLength string                  `json:"completedLength"`
@@ -97,16 +137,181 @@ type StatusResultFileUri struct {
 	Uri    string `json:"uri"`
 }
 
+// ClientOptions are the connection options of the aria2 rpc server
+type ClientOptions struct {
+	Scheme   string // http, https, ws or wss, default http
+	Path     string // rpc path, default /jsonrpc
+	CAFile   string // PEM CA bundle to verify the server certificate, default system roots
+	CertFile string // PEM client certificate, with KeyFile
+	KeyFile  string
+	Insecure bool // skip the server certificate verification
+}
+
 func NewClient(host string, port int, secret string) *Client {
-	return &Client{
-		token:     secret,
-		serverUrl: fmt.Sprintf("http://%s:%d/jsonrpc", host, port),
+	client, _ := NewClientWithOptions(host, port, secret, nil)
+	return client
+}
+
+// NewWsClient creates a client which sends requests and receives notifications over websocket,
+// requests fall back to http while the websocket connection is closed and redialed
+func NewWsClient(host string, port int, secret string) (*Client, error) {
+	return NewClientWithOptions(host, port, secret, &ClientOptions{Scheme: SchemeWs})
+}
+
+// NewClientWithOptions creates a client of the rpc server at scheme://host:port/path, port is omitted if 0
+// with https/wss, and is 6800 if 0 with http/ws. A ws/wss client dials the websocket at once
+func NewClientWithOptions(host string, port int, secret string, opts *ClientOptions) (*Client, error) {
+	if opts == nil {
+		opts = new(ClientOptions)
+	}
+	scheme := strings.ToLower(opts.Scheme)
+	if scheme == "" {
+		scheme = SchemeHttp
+	}
+	var httpScheme string
+	switch scheme {
+	case SchemeHttp, SchemeWs:
+		httpScheme = SchemeHttp
+		if port == 0 {
+			port = defaultPort
+		}
+	case SchemeHttps, SchemeWss:
+		httpScheme = SchemeHttps
+	default:
+		return nil, fmt.Errorf("not supported aria2 scheme: %s", opts.Scheme)
+	}
+	path := opts.Path
+	if path == "" {
+		path = defaultPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	addr := host
+	if port > 0 {
+		addr = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client := &Client{
+		token:      secret,
+		serverUrl:  httpScheme + "://" + addr + path,
+		httpClient: &http.Client{Transport: transport},
+		done:       make(chan struct{}),
+	}
+	if scheme == SchemeWs || scheme == SchemeWss {
+		client.wsUrl, client.tlsConfig = scheme+"://"+addr+path, tlsConfig
+		client.subs = make(map[chan Notification]struct{})
+		if client.ws, err = dialWs(client.wsUrl, tlsConfig, client.notify); err != nil {
+			return nil, err
+		}
+		go client.keepWs(client.ws)
+	}
+	return client, nil
+}
+
+// tlsConfig returns the tls config with the CA bundle and client certificate, verification is on unless Insecure
+func (opts *ClientOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: opts.Insecure}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca file: %s", opts.CAFile)
+		}
+		config.RootCAs = pool
 	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Subscribe returns a channel of aria2 notifications until the client is closed, the channel is nil without websocket.
+// Notifications may be dropped when the receiver is slow or the websocket is redialing, so status polling is still needed,
+// see Notified.
+func (aria2Client *Client) Subscribe() (<-chan Notification, func()) {
+	aria2Client.mu.Lock()
+	defer aria2Client.mu.Unlock()
+	if aria2Client.subs == nil {
+		return nil, func() {}
+	}
+	ch := make(chan Notification, wsSubscribeBuf)
+	select {
+	case <-aria2Client.done:
+		close(ch)
+		return ch, func() {}
+	default:
+	}
+	aria2Client.subs[ch] = struct{}{}
+	return ch, func() {
+		aria2Client.mu.Lock()
+		defer aria2Client.mu.Unlock()
+		if _, ok := aria2Client.subs[ch]; ok {
+			delete(aria2Client.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Notified returns whether notifications are received now, false without websocket or while redialing
+func (aria2Client *Client) Notified() bool {
+	ws := aria2Client.conn()
+	return ws != nil && !ws.closed()
+}
+
+// Close closes the websocket and stops redialing, the subscribed channels are closed
+func (aria2Client *Client) Close() (err error) {
+	aria2Client.closeOnce.Do(func() {
+		close(aria2Client.done)
+		aria2Client.mu.Lock()
+		ws := aria2Client.ws
+		for ch := range aria2Client.subs {
+			delete(aria2Client.subs, ch)
+			close(ch)
+		}
+		aria2Client.mu.Unlock()
+		if ws != nil {
+			err = ws.close()
+		}
+	})
+	return
+}
+
+func (aria2Client *Client) conn() *wsConn {
+	aria2Client.mu.Lock()
+	defer aria2Client.mu.Unlock()
+	return aria2Client.ws
+}
+
+func (aria2Client *Client) call(payload *Payload) ([]byte, error) {
+	if ws := aria2Client.conn(); ws != nil && !ws.closed() {
+		return ws.call(payload)
+	}
+	return httpRequest(aria2Client.httpClient, http.MethodPost, aria2Client.serverUrl, "", payload, nil)
 }
 
 func (aria2Client *Client) DownloadStatus(gid string) (ok bool, err error) {
+	_, ok, err = aria2Client.DownloadState(gid)
+	return
+}
+
+// DownloadState returns the status result of the download, ok is true if the download is complete
+func (aria2Client *Client) DownloadState(gid string) (result *StatusResult, ok bool, err error) {
 	payload := aria2Client.StatusPayload(gid)
-	response, err := httpRequest(http.MethodPost, aria2Client.serverUrl, "", payload, nil)
+	response, err := aria2Client.call(payload)
 	if err != nil {
 		return
 	}
@@ -115,54 +320,51 @@ func (aria2Client *Client) DownloadStatus(gid string) (ok bool, err error) {
 		return
 	}
 	if aria2Status.Error != nil {
-		return false, errors.New(aria2Status.Error.Message)
+		return nil, false, errors.New(aria2Status.Error.Message)
 	}
 	if aria2Status.Result == nil || len(aria2Status.Result.Files) != 1 {
-		return false, errors.New("invalid response")
+		return nil, false, errors.New("invalid response")
 	}
 
-	result := aria2Status.Result
-	file := result.Files[0]
-	filePath := file.Path
-	fileSize, _ := strconv.Atoi(file.Length)
+	result = aria2Status.Result
+	filePath := result.Files[0].Path
 
 	switch result.Status {
 	case StatusError:
-		return false, errors.New(result.ErrorMessage)
-	case StatusWaiting:
-		return
-	case StatusActive:
-		time.Sleep(time.Second * 5)
-		fileInfo, err := os.Stat(filePath)
-		var fileSizeDownloaded int64
-		if err != nil {
-			fileSizeDownloaded = -1
-		} else {
-			fileSizeDownloaded = fileInfo.Size()
-		}
-		completedLen, _ := strconv.Atoi(file.CompletedLength)
-		var completePercent float64 = 0
-		if fileSize > 0 {
-			completePercent = float64(completedLen) / float64(fileSize) * 100
-		}
-		speed, _ := strconv.Atoi(result.DownloadSpeed)
-		downloadSpeed := speed / 1024
-		fileSizeDownloaded = fileSizeDownloaded / 1024
-		fmt.Printf("the current ipfs data file downloading, complete: %.2f%%, speed: %dKiB, downloaded: %dKiB, %s, download gid: %s\n", completePercent, downloadSpeed, fileSizeDownloaded, result.Status, gid)
-		return false, nil
+		code, _ := strconv.Atoi(result.ErrorCode)
+		return result, false, &DownloadError{Gid: gid, Code: code, Message: result.ErrorMessage}
+	case StatusWaiting, StatusActive:
+		return result, false, nil
 	case StatusComplete:
 		_, err := os.Stat(filePath)
 		if err != nil {
-			return false, fmt.Errorf("download gid: %s, error: %s, please check aria2 services", gid, err.Error())
+			return result, false, fmt.Errorf("download gid: %s, error: %s, please check aria2 services", gid, err.Error())
 		}
-		return true, nil
+		return result, true, nil
 	}
-	return false, fmt.Errorf("invalid download status: %s", result.Status)
+	return result, false, fmt.Errorf("invalid download status: %s", result.Status)
+}
+
+// Lengths returns the completed and total length of the download
+func (result *StatusResult) Lengths() (completed, total int64) {
+	completed, _ = strconv.ParseInt(result.CompletedLength, 10, 64)
+	total, _ = strconv.ParseInt(result.TotalLength, 10, 64)
+	return
 }
 
 func (aria2Client *Client) DownloadFile(uri string, outDir, outFilename string) (gid string, err error) {
-	payload := aria2Client.DownloadPayload(aria2AddURI, uri, outDir, outFilename)
-	response, err := httpRequest(http.MethodPost, aria2Client.serverUrl, "", payload, nil)
+	return aria2Client.DownloadURIs([]string{uri}, outDir, outFilename)
+}
+
+// DownloadURIs downloads one file from all uris, uris must point to the same resource,
+// aria2 splits the download across them and fails over between them.
+// Out and Dir of option are replaced by outFilename and outDir
+func (aria2Client *Client) DownloadURIs(uris []string, outDir, outFilename string, option ...*DownloadOption) (gid string, err error) {
+	if len(uris) == 0 {
+		return "", errors.New("no download uris")
+	}
+	payload := aria2Client.DownloadPayload(aria2AddURI, uris, outDir, outFilename, option...)
+	response, err := aria2Client.call(payload)
 	if err != nil {
 		return
 	}
@@ -185,20 +387,22 @@ func (aria2Client *Client) StatusPayload(gid string) *Payload {
 	}
 }
 
-func (aria2Client *Client) DownloadPayload(method string, uri string, outDir, outFilename string) *Payload {
-	options := DownloadOption{
-		Out: outFilename,
-		Dir: outDir,
+func (aria2Client *Client) DownloadPayload(method string, uris []string, outDir, outFilename string, option ...*DownloadOption) *Payload {
+	var options DownloadOption
+	if len(option) > 0 && option[0] != nil {
+		options = *option[0]
 	}
+	options.Out = outFilename
+	options.Dir = outDir
 	return &Payload{
 		JsonRpc: "2.0",
-		Id:      uri,
+		Id:      uris[0],
 		Method:  method,
-		Params:  []interface{}{"token:" + aria2Client.token, []string{uri}, options},
+		Params:  []interface{}{"token:" + aria2Client.token, uris, options},
 	}
 }
 
-func httpRequest(httpMethod, uri, tokenString string, params interface{}, timeout *time.Duration) (body []byte, err error) {
+func httpRequest(client *http.Client, httpMethod, uri, tokenString string, params interface{}, timeout *time.Duration) (body []byte, err error) {
 	var req *http.Request
 	switch params := params.(type) {
 	case io.Reader:
@@ -224,12 +428,10 @@ func httpRequest(httpMethod, uri, tokenString string, params interface{}, timeou
 		req.Header.Set("Authorization", "Bearer "+tokenString)
 	}
 
-	customTransport := http.DefaultTransport.(*http.Transport).Clone()
-	customTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-
-	client := &http.Client{Transport: customTransport}
 	if timeout != nil {
-		client.Timeout = *timeout
+		c := *client
+		c.Timeout = *timeout
+		client = &c
 	}
 
 	resp, err := client.Do(req)
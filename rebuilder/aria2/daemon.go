@@ -0,0 +1,290 @@
+package aria2
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+)
+
+const (
+	defaultBin          = "aria2c"
+	daemonHost          = "127.0.0.1"
+	daemonStartTimeout  = 10 * time.Second
+	daemonStopTimeout   = 10 * time.Second
+	daemonMaxRestarts   = 3
+	daemonRestartDelay  = 2 * time.Second
+	daemonSessionSaving = 30 // seconds
+)
+
+// DaemonOptions are the options of a local aria2c process, empty Port and Secret are generated
+type DaemonOptions struct {
+	Bin     string // aria2c binary, default aria2c in PATH
+	Port    int
+	Secret  string
+	Session string // session file to save and resume unfinished downloads
+	Dir     string // default download dir
+}
+
+// Daemon is a local aria2c rpc server started and supervised by the rebuilder,
+// it is restarted with the saved session if it exits unexpectedly
+type Daemon struct {
+	opts DaemonOptions
+
+	confPath string // conf file holding the rpc secret, which is kept out of the command line
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	stopping bool
+	restarts int
+	done     chan struct{}
+}
+
+// StartDaemon starts aria2c and waits until its rpc server is ready
+func StartDaemon(opts DaemonOptions) (*Daemon, error) {
+	if opts.Bin == "" {
+		opts.Bin = defaultBin
+	}
+	bin, err := exec.LookPath(opts.Bin)
+	if err != nil {
+		return nil, fmt.Errorf("aria2c not found, install aria2 or set aria2 host: %w", err)
+	}
+	opts.Bin = bin
+	if opts.Port == 0 {
+		if opts.Port, err = freePort(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Secret == "" {
+		if opts.Secret, err = randomSecret(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Session != "" {
+		if err = os.MkdirAll(filepath.Dir(opts.Session), 0766); err != nil {
+			return nil, err
+		}
+	}
+	d := &Daemon{
+		opts: opts,
+		done: make(chan struct{}),
+	}
+	if err = d.writeConf(); err != nil {
+		return nil, err
+	}
+	if err = d.start(); err != nil {
+		os.Remove(d.confPath)
+		return nil, err
+	}
+	go d.supervise()
+	return d, nil
+}
+
+func (d *Daemon) Host() string {
+	return daemonHost
+}
+
+func (d *Daemon) Port() int {
+	return d.opts.Port
+}
+
+func (d *Daemon) Secret() string {
+	return d.opts.Secret
+}
+
+// writeConf writes the rpc secret into a conf file only readable by the current user,
+// so the secret is not visible in the process list
+func (d *Daemon) writeConf() error {
+	// created with mode 0600
+	f, err := os.CreateTemp("", "aria2-*.conf")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "rpc-secret=%s\n", d.opts.Secret)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	d.confPath = f.Name()
+	return nil
+}
+
+func (d *Daemon) args() []string {
+	args := []string{
+		"--conf-path=" + d.confPath,
+		"--enable-rpc",
+		"--rpc-listen-all=false",
+		"--rpc-listen-port=" + strconv.Itoa(d.opts.Port),
+		"--stop-with-process=" + strconv.Itoa(os.Getpid()),
+		"--console-log-level=warn",
+		"--summary-interval=0",
+	}
+	if d.opts.Dir != "" {
+		args = append(args, "--dir="+d.opts.Dir)
+	}
+	if d.opts.Session != "" {
+		args = append(args,
+			"--save-session="+d.opts.Session,
+			"--save-session-interval="+strconv.Itoa(daemonSessionSaving),
+		)
+		if _, err := os.Stat(d.opts.Session); err == nil {
+			args = append(args, "--input-file="+d.opts.Session)
+		}
+	}
+	return args
+}
+
+// start runs aria2c and health-checks the rpc server
+func (d *Daemon) start() error {
+	d.mu.Lock()
+	cmd, exited, err := d.launch()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return d.ready(cmd, exited)
+}
+
+// launch runs aria2c as the process of the daemon, d.mu must be held so Stop always sees the running process
+func (d *Daemon) launch() (*exec.Cmd, chan struct{}, error) {
+	cmd := exec.Command(d.opts.Bin, d.args()...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	d.cmd, d.exited = cmd, exited
+	return cmd, exited, nil
+}
+
+// ready waits until the rpc server of cmd is ready, cmd is killed if not ready in time
+func (d *Daemon) ready(cmd *exec.Cmd, exited chan struct{}) error {
+	client := NewClient(daemonHost, d.opts.Port, d.opts.Secret)
+	deadline := time.Now().Add(daemonStartTimeout)
+	for {
+		version, err := client.GetVersion()
+		if err == nil {
+			log.Infof("aria2 %s started on port %d, pid %d", version.Version, d.opts.Port, cmd.Process.Pid)
+			return nil
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("aria2c exited on start: %s", cmd.ProcessState)
+		case <-time.After(200 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			return fmt.Errorf("aria2c not ready in %s: %w", daemonStartTimeout, err)
+		}
+	}
+}
+
+// supervise restarts aria2c when it exits without Stop
+func (d *Daemon) supervise() {
+	defer close(d.done)
+	for {
+		d.mu.Lock()
+		exited := d.exited
+		d.mu.Unlock()
+		<-exited
+
+		d.mu.Lock()
+		if d.stopping {
+			d.mu.Unlock()
+			return
+		}
+		d.restarts++
+		restarts := d.restarts
+		d.mu.Unlock()
+		if restarts > daemonMaxRestarts {
+			log.Errorf("aria2c exited %d times, give up restarting", restarts)
+			return
+		}
+		log.Warnf("aria2c exited unexpectedly, restart %d/%d", restarts, daemonMaxRestarts)
+		time.Sleep(daemonRestartDelay)
+
+		// Stop may be called while sleeping, the process is started under the lock so it is stopped by Stop
+		d.mu.Lock()
+		if d.stopping {
+			d.mu.Unlock()
+			return
+		}
+		cmd, exited, err := d.launch()
+		d.mu.Unlock()
+		if err == nil {
+			err = d.ready(cmd, exited)
+		}
+		if err != nil {
+			log.Error("restart aria2c failed: ", err)
+			return
+		}
+	}
+}
+
+// Stop shuts down aria2c gracefully to save the session, it is killed if not exited in time
+func (d *Daemon) Stop() error {
+	d.mu.Lock()
+	if d.stopping {
+		d.mu.Unlock()
+		return nil
+	}
+	d.stopping = true
+	cmd, exited := d.cmd, d.exited
+	d.mu.Unlock()
+	defer os.Remove(d.confPath)
+
+	select {
+	case <-exited:
+		<-d.done
+		return nil
+	default:
+	}
+	client := NewClient(daemonHost, d.opts.Port, d.opts.Secret)
+	if err := client.Shutdown(); err != nil {
+		log.Warn("shutdown aria2c failed: ", err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(daemonStopTimeout):
+		if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return err
+		}
+		<-exited
+	}
+	<-d.done
+	return nil
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", daemonHost+":0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func randomSecret() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
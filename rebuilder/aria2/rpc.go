@@ -0,0 +1,266 @@
+package aria2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	aria2Remove               = "aria2.remove"
+	aria2ForceRemove          = "aria2.forceRemove"
+	aria2Pause                = "aria2.pause"
+	aria2Unpause              = "aria2.unpause"
+	aria2TellActive           = "aria2.tellActive"
+	aria2TellWaiting          = "aria2.tellWaiting"
+	aria2TellStopped          = "aria2.tellStopped"
+	aria2GetGlobalStat        = "aria2.getGlobalStat"
+	aria2ChangeOption         = "aria2.changeOption"
+	aria2ChangeGlobalOption   = "aria2.changeGlobalOption"
+	aria2SaveSession          = "aria2.saveSession"
+	aria2PurgeDownloadResult  = "aria2.purgeDownloadResult"
+	aria2RemoveDownloadResult = "aria2.removeDownloadResult"
+	aria2GetVersion           = "aria2.getVersion"
+	aria2Shutdown             = "aria2.shutdown"
+	aria2ForceShutdown        = "aria2.forceShutdown"
+	systemMulticall           = "system.multicall"
+)
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("aria2 rpc error code: %d, %s", e.Code, e.Message)
+}
+
+type rpcResp struct {
+	Id      string          `json:"id"`
+	JsonRpc string          `json:"jsonrpc"`
+	Error   *Error          `json:"error"`
+	Result  json.RawMessage `json:"result"`
+}
+
+type Version struct {
+	Version         string   `json:"version"`
+	EnabledFeatures []string `json:"enabledFeatures"`
+}
+
+type GlobalStat struct {
+	DownloadSpeed   string `json:"downloadSpeed"`
+	UploadSpeed     string `json:"uploadSpeed"`
+	NumActive       string `json:"numActive"`
+	NumWaiting      string `json:"numWaiting"`
+	NumStopped      string `json:"numStopped"`
+	NumStoppedTotal string `json:"numStoppedTotal"`
+}
+
+// Call is one method call of system.multicall, the secret token is added by the client
+type Call struct {
+	Method string
+	Params []interface{}
+}
+
+func NewCall(method string, params ...interface{}) *Call {
+	return &Call{
+		Method: method,
+		Params: params,
+	}
+}
+
+// CallResult is the result of one call in system.multicall, Error is set if the call failed
+type CallResult struct {
+	Result json.RawMessage
+	Error  *Error
+}
+
+// Unmarshal decodes the call result into v, or returns the call error
+func (r *CallResult) Unmarshal(v interface{}) error {
+	if r.Error != nil {
+		return r.Error
+	}
+	return json.Unmarshal(r.Result, v)
+}
+
+// rpc calls the aria2 method with the secret token prepended to params, and decodes the result into result
+func (aria2Client *Client) rpc(method string, result interface{}, params ...interface{}) error {
+	return aria2Client.do(method, result, append([]interface{}{"token:" + aria2Client.token}, params...))
+}
+
+func (aria2Client *Client) do(method string, result interface{}, params []interface{}) error {
+	payload := &Payload{
+		JsonRpc: "2.0",
+		Id:      method,
+		Method:  method,
+		Params:  params,
+	}
+	response, err := aria2Client.call(payload)
+	if err != nil {
+		return err
+	}
+	var resp rpcResp
+	if err = json.Unmarshal(response, &resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+func (aria2Client *Client) gidRpc(method, gid string) error {
+	var result string
+	if err := aria2Client.rpc(method, &result, gid); err != nil {
+		return err
+	}
+	if result != gid {
+		return fmt.Errorf("%s unexpected result gid: %s", method, result)
+	}
+	return nil
+}
+
+func (aria2Client *Client) okRpc(method string, params ...interface{}) error {
+	var result string
+	if err := aria2Client.rpc(method, &result, params...); err != nil {
+		return err
+	}
+	if result != "OK" {
+		return fmt.Errorf("%s unexpected result: %s", method, result)
+	}
+	return nil
+}
+
+// Remove removes the download, an active download is stopped first
+func (aria2Client *Client) Remove(gid string) error {
+	return aria2Client.gidRpc(aria2Remove, gid)
+}
+
+// ForceRemove removes the download without any action which takes time
+func (aria2Client *Client) ForceRemove(gid string) error {
+	return aria2Client.gidRpc(aria2ForceRemove, gid)
+}
+
+func (aria2Client *Client) Pause(gid string) error {
+	return aria2Client.gidRpc(aria2Pause, gid)
+}
+
+func (aria2Client *Client) Unpause(gid string) error {
+	return aria2Client.gidRpc(aria2Unpause, gid)
+}
+
+// TellStatus returns the status of the download, only keys are returned if set
+func (aria2Client *Client) TellStatus(gid string, keys ...string) (result *StatusResult, err error) {
+	params := []interface{}{gid}
+	if len(keys) > 0 {
+		params = append(params, keys)
+	}
+	err = aria2Client.rpc(aria2Status, &result, params...)
+	return
+}
+
+func (aria2Client *Client) TellActive(keys ...string) (results []*StatusResult, err error) {
+	var params []interface{}
+	if len(keys) > 0 {
+		params = append(params, keys)
+	}
+	err = aria2Client.rpc(aria2TellActive, &results, params...)
+	return
+}
+
+// TellWaiting returns num waiting downloads from offset, negative offset counts from the last one
+func (aria2Client *Client) TellWaiting(offset, num int, keys ...string) (results []*StatusResult, err error) {
+	params := []interface{}{offset, num}
+	if len(keys) > 0 {
+		params = append(params, keys)
+	}
+	err = aria2Client.rpc(aria2TellWaiting, &results, params...)
+	return
+}
+
+// TellStopped returns num stopped downloads from offset, negative offset counts from the last one
+func (aria2Client *Client) TellStopped(offset, num int, keys ...string) (results []*StatusResult, err error) {
+	params := []interface{}{offset, num}
+	if len(keys) > 0 {
+		params = append(params, keys)
+	}
+	err = aria2Client.rpc(aria2TellStopped, &results, params...)
+	return
+}
+
+func (aria2Client *Client) GetGlobalStat() (stat *GlobalStat, err error) {
+	err = aria2Client.rpc(aria2GetGlobalStat, &stat)
+	return
+}
+
+// ChangeOption changes the options of the download dynamically
+func (aria2Client *Client) ChangeOption(gid string, options map[string]string) error {
+	return aria2Client.okRpc(aria2ChangeOption, gid, options)
+}
+
+func (aria2Client *Client) ChangeGlobalOption(options map[string]string) error {
+	return aria2Client.okRpc(aria2ChangeGlobalOption, options)
+}
+
+// SaveSession saves the session to the file specified by --save-session of aria2
+func (aria2Client *Client) SaveSession() error {
+	return aria2Client.okRpc(aria2SaveSession)
+}
+
+// PurgeDownloadResult purges completed/error/removed downloads to free memory
+func (aria2Client *Client) PurgeDownloadResult() error {
+	return aria2Client.okRpc(aria2PurgeDownloadResult)
+}
+
+// RemoveDownloadResult removes the completed/error/removed download from memory
+func (aria2Client *Client) RemoveDownloadResult(gid string) error {
+	return aria2Client.okRpc(aria2RemoveDownloadResult, gid)
+}
+
+func (aria2Client *Client) GetVersion() (version *Version, err error) {
+	err = aria2Client.rpc(aria2GetVersion, &version)
+	return
+}
+
+// Shutdown shuts down aria2 after stopping active downloads, the session is saved if configured
+func (aria2Client *Client) Shutdown() error {
+	return aria2Client.okRpc(aria2Shutdown)
+}
+
+func (aria2Client *Client) ForceShutdown() error {
+	return aria2Client.okRpc(aria2ForceShutdown)
+}
+
+// Multicall calls multiple methods in a single request, results are in the order of calls
+func (aria2Client *Client) Multicall(calls ...*Call) (results []*CallResult, err error) {
+	if len(calls) == 0 {
+		return nil, errors.New("no calls")
+	}
+	methods := make([]map[string]interface{}, 0, len(calls))
+	for _, call := range calls {
+		methods = append(methods, map[string]interface{}{
+			"methodName": call.Method,
+			"params":     append([]interface{}{"token:" + aria2Client.token}, call.Params...),
+		})
+	}
+	var raws []json.RawMessage
+	if err = aria2Client.do(systemMulticall, &raws, []interface{}{methods}); err != nil {
+		return
+	}
+	if len(raws) != len(calls) {
+		return nil, fmt.Errorf("multicall expected %d results, got %d", len(calls), len(raws))
+	}
+	// a succeeded call returns [result], a failed call returns {code, message}
+	for _, raw := range raws {
+		result := new(CallResult)
+		var values []json.RawMessage
+		if err = json.Unmarshal(raw, &values); err == nil && len(values) == 1 {
+			result.Result = values[0]
+		} else {
+			result.Error = new(Error)
+			if err = json.Unmarshal(raw, result.Error); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
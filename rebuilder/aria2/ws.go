@@ -0,0 +1,208 @@
+package aria2
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	NotifyDownloadStart      = "aria2.onDownloadStart"
+	NotifyDownloadPause      = "aria2.onDownloadPause"
+	NotifyDownloadStop       = "aria2.onDownloadStop"
+	NotifyDownloadComplete   = "aria2.onDownloadComplete"
+	NotifyDownloadError      = "aria2.onDownloadError"
+	NotifyBtDownloadComplete = "aria2.onBtDownloadComplete"
+
+	wsCallTimeout  = 30 * time.Second
+	wsSubscribeBuf = 64
+	// backoff of redialing the closed websocket
+	wsRedialMin = time.Second
+	wsRedialMax = time.Minute
+)
+
+// Notification is an event pushed by aria2 over websocket
+type Notification struct {
+	Method string
+	Gid    string
+}
+
+type wsMessage struct {
+	Id     string `json:"id"`
+	Method string `json:"method"`
+	Params []struct {
+		Gid string `json:"gid"`
+	} `json:"params"`
+}
+
+type wsConn struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	id      uint64
+	pending map[string]chan []byte
+	notify  func(Notification)
+	done    chan struct{}
+	err     error
+}
+
+// dialWs dials the websocket, notify is called by the read loop with each notification
+func dialWs(url string, tlsConfig *tls.Config, notify func(Notification)) (*wsConn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	ws := &wsConn{
+		conn:    conn,
+		pending: make(map[string]chan []byte),
+		notify:  notify,
+		done:    make(chan struct{}),
+	}
+	go ws.readLoop()
+	return ws, nil
+}
+
+func (ws *wsConn) readLoop() {
+	var err error
+	defer func() {
+		ws.mu.Lock()
+		ws.err = err
+		ws.mu.Unlock()
+		close(ws.done)
+	}()
+	for {
+		var b []byte
+		if _, b, err = ws.conn.ReadMessage(); err != nil {
+			return
+		}
+		var msg wsMessage
+		if e := json.Unmarshal(b, &msg); e != nil {
+			continue
+		}
+		if msg.Id == "" && msg.Method != "" {
+			for _, param := range msg.Params {
+				ws.notify(Notification{Method: msg.Method, Gid: param.Gid})
+			}
+			continue
+		}
+		ws.mu.Lock()
+		ch, ok := ws.pending[msg.Id]
+		delete(ws.pending, msg.Id)
+		ws.mu.Unlock()
+		if ok {
+			ch <- b
+		}
+	}
+}
+
+func (ws *wsConn) call(payload *Payload) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	ws.mu.Lock()
+	ws.id++
+	payload.Id = strconv.FormatUint(ws.id, 10)
+	ws.pending[payload.Id] = ch
+	ws.mu.Unlock()
+	defer func() {
+		ws.mu.Lock()
+		delete(ws.pending, payload.Id)
+		ws.mu.Unlock()
+	}()
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	ws.writeMu.Lock()
+	err = ws.conn.WriteMessage(websocket.TextMessage, b)
+	ws.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(wsCallTimeout)
+	defer timer.Stop()
+	select {
+	case b = <-ch:
+		return b, nil
+	case <-ws.done:
+		return nil, fmt.Errorf("aria2 websocket closed: %v", ws.err)
+	case <-timer.C:
+		return nil, errors.New("aria2 websocket call timeout")
+	}
+}
+
+func (ws *wsConn) closed() bool {
+	select {
+	case <-ws.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ws *wsConn) close() error {
+	err := ws.conn.Close()
+	<-ws.done
+	return err
+}
+
+// keepWs redials with backoff once ws is closed until the client is closed
+func (aria2Client *Client) keepWs(ws *wsConn) {
+	for {
+		<-ws.done
+		select {
+		case <-aria2Client.done:
+			return
+		default:
+		}
+		log.Warnf("aria2 websocket closed: %v, redialing", ws.err)
+		backoff := wsRedialMin
+		for {
+			select {
+			case <-aria2Client.done:
+				return
+			case <-time.After(backoff):
+			}
+			next, err := dialWs(aria2Client.wsUrl, aria2Client.tlsConfig, aria2Client.notify)
+			if err == nil {
+				aria2Client.mu.Lock()
+				select {
+				case <-aria2Client.done:
+					aria2Client.mu.Unlock()
+					next.close()
+					return
+				default:
+				}
+				aria2Client.ws, ws = next, next
+				aria2Client.mu.Unlock()
+				log.Info("aria2 websocket reconnected")
+				break
+			}
+			log.Debugf("redial aria2 websocket failed: %v", err)
+			if backoff *= 2; backoff > wsRedialMax {
+				backoff = wsRedialMax
+			}
+		}
+	}
+}
+
+// notify sends the notification to the subscribers, dropped if the subscriber is full
+func (aria2Client *Client) notify(event Notification) {
+	aria2Client.mu.Lock()
+	defer aria2Client.mu.Unlock()
+	for ch := range aria2Client.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package aria2
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	if err := log.Init(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// testServer is a stand-in aria2 rpc server answering getVersion over http and websocket,
+// the websocket connections are sent to conns
+type testServer struct {
+	*httptest.Server
+	conns chan *testConn
+	mu    sync.Mutex
+	posts int
+}
+
+type testConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (c *testConn) write(t *testing.T, v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.conn.WriteJSON(v); err != nil {
+		t.Error(err)
+	}
+}
+
+func (c *testConn) notify(t *testing.T, method string, gids ...string) {
+	params := make([]map[string]string, 0, len(gids))
+	for _, gid := range gids {
+		params = append(params, map[string]string{"gid": gid})
+	}
+	c.write(t, map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func newTestServer(t *testing.T) (*testServer, *Client) {
+	server := &testServer{conns: make(chan *testConn, 4)}
+	upgrader := websocket.Upgrader{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			server.mu.Lock()
+			server.posts++
+			server.mu.Unlock()
+			var payload Payload
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(versionResp(payload.Id, "http"))
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := &testConn{conn: conn}
+		server.conns <- c
+		for {
+			var payload Payload
+			if err := conn.ReadJSON(&payload); err != nil {
+				return
+			}
+			c.write(t, versionResp(payload.Id, "ws"))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	client, err := NewClientWithOptions(host, p, "", &ClientOptions{Scheme: SchemeWs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+// versionResp answers getVersion with the transport as the version
+func versionResp(id, transport string) map[string]interface{} {
+	return map[string]interface{}{"id": id, "jsonrpc": "2.0", "result": map[string]interface{}{"version": transport}}
+}
+
+func (server *testServer) conn(t *testing.T) *testConn {
+	select {
+	case c := <-server.conns:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("websocket not dialed")
+		return nil
+	}
+}
+
+func receive(t *testing.T, ch <-chan Notification) Notification {
+	select {
+	case event, ok := <-ch:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not received")
+		return Notification{}
+	}
+}
+
+func waitNotified(t *testing.T, client *Client, notified bool) {
+	deadline := time.Now().Add(5 * wsRedialMin)
+	for client.Notified() != notified {
+		if time.Now().After(deadline) {
+			t.Fatalf("notified not %v", notified)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWsNotification(t *testing.T) {
+	server, client := newTestServer(t)
+	conn := server.conn(t)
+	tests := []struct {
+		name    string
+		message interface{}
+		want    []Notification
+	}{
+		{"complete", map[string]interface{}{"jsonrpc": "2.0", "method": NotifyDownloadComplete, "params": []map[string]string{{"gid": "1"}}},
+			[]Notification{{NotifyDownloadComplete, "1"}}},
+		{"gids", map[string]interface{}{"jsonrpc": "2.0", "method": NotifyDownloadError, "params": []map[string]string{{"gid": "1"}, {"gid": "2"}}},
+			[]Notification{{NotifyDownloadError, "1"}, {NotifyDownloadError, "2"}}},
+		{"response not notification", versionResp("100", "ws"), nil},
+		{"invalid", "not json", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, unsubscribe := client.Subscribe()
+			defer unsubscribe()
+			conn.write(t, tt.message)
+			conn.notify(t, NotifyDownloadStop, "end")
+			var got []Notification
+			for event := receive(t, ch); event.Gid != "end"; event = receive(t, ch) {
+				got = append(got, event)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("notifications %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	version, err := client.GetVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != "ws" {
+		t.Fatalf("called over %s, want ws", version.Version)
+	}
+}
+
+// TestWsRedial falls back to http while the websocket is closed, then redials it and keeps the subscriptions
+func TestWsRedial(t *testing.T) {
+	server, client := newTestServer(t)
+	ch, unsubscribe := client.Subscribe()
+	defer unsubscribe()
+	server.conn(t).conn.Close()
+	waitNotified(t, client, false)
+
+	version, err := client.GetVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != "http" {
+		t.Fatalf("called over %s while closed, want http", version.Version)
+	}
+
+	conn := server.conn(t)
+	waitNotified(t, client, true)
+	if version, err = client.GetVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != "ws" {
+		t.Fatalf("called over %s after redial, want ws", version.Version)
+	}
+	conn.notify(t, NotifyDownloadComplete, "1")
+	if event := receive(t, ch); event != (Notification{NotifyDownloadComplete, "1"}) {
+		t.Fatalf("notification %v after redial", event)
+	}
+
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("subscription not closed with the client")
+	}
+	if client.Notified() {
+		t.Fatal("notified after close")
+	}
+	select {
+	case <-server.conns:
+		t.Fatal("redialed after close")
+	case <-time.After(2 * wsRedialMin):
+	}
+}
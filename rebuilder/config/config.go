@@ -10,6 +10,10 @@ type Config struct {
 	Task     *Task     `toml:"task"`
 	MCS      *MCS      `toml:"mcs"`
 	Lotus    *Lotus    `toml:"lotus"`
+	Retry    *Retry    `toml:"retry,omitempty"`
+	Download *Download `toml:"download,omitempty"`
+	Gateway  *Gateway  `toml:"gateway,omitempty"`
+	S3       *S3       `toml:"s3,omitempty"`
 	Log      *Log      `toml:"log,omitempty"`
 }
 
@@ -23,15 +27,64 @@ type Database struct {
 }
 
 type Aria2 struct {
-	Host   string `toml:"host"`
-	Port   int    `toml:"port"`
-	Secret string `toml:"secret"`
+	Host     string `toml:"host"`
+	Port     int    `toml:"port"`
+	Secret   string `toml:"secret"`
+	Scheme   string `toml:"scheme"`
+	Path     string `toml:"path"`
+	CAFile   string `toml:"ca_file"`
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	Insecure bool   `toml:"insecure"`
+	Bin      string `toml:"bin"`
+	Session  string `toml:"session"`
 }
 
 type Task struct {
-	InputPath  string `toml:"input_path"`
-	OutputPath string `toml:"output_path"`
-	Parallel   int    `toml:"parallel"`
+	InputPath     string `toml:"input_path"`
+	OutputPath    string `toml:"output_path"`
+	Parallel      int    `toml:"parallel"`
+	Fetcher       string `toml:"fetcher"`
+	Connections   int    `toml:"connections"`
+	KeepGoing     bool   `toml:"keep_going"`
+	Force         bool   `toml:"force"`
+	LocalMode     string `toml:"local_mode"`
+	Streaming     bool   `toml:"streaming"`
+	SkipVerify    bool   `toml:"skip_verify"`
+	Path          string `toml:"path"`
+	GraphManifest string `toml:"graph_manifest"`
+	Source        string `toml:"source"`
+	Restorer      string `toml:"restorer"`
+	Sink          string `toml:"sink"`
+}
+
+type Retry struct {
+	Attempts   int   `toml:"attempts"`
+	Backoff    int   `toml:"backoff"`
+	MaxBackoff int   `toml:"max_backoff"`
+	Aria2Codes []int `toml:"aria2_codes"`
+}
+
+// Download sets the options of each download, options of the matched host override the global ones
+type Download struct {
+	DownloadOptions
+	Hosts []*DownloadHost `toml:"hosts"`
+}
+
+type DownloadHost struct {
+	Host string `toml:"host"`
+	DownloadOptions
+}
+
+type DownloadOptions struct {
+	MaxDownloadLimit       string   `toml:"max_download_limit"`
+	Split                  int      `toml:"split"`
+	MaxConnectionPerServer int      `toml:"max_connection_per_server"`
+	Headers                []string `toml:"headers"`
+	UserAgent              string   `toml:"user_agent"`
+	Checksum               bool     `toml:"checksum"`
+	Continue               bool     `toml:"continue"`
+	AllProxy               string   `toml:"all_proxy"`
 }
 
 type MCS struct {
@@ -41,6 +94,20 @@ type MCS struct {
 	BucketName string `toml:"bucket_name"`
 }
 
+type Gateway struct {
+	URLs    []string `toml:"urls"`
+	Timeout int      `toml:"timeout"` // seconds of each car download
+}
+
+type S3 struct {
+	Endpoint     string `toml:"endpoint"`
+	Region       string `toml:"region"`
+	AccessKey    string `toml:"access_key"`
+	SecretKey    string `toml:"secret_key"`
+	SessionToken string `toml:"session_token"`
+	PathStyle    bool   `toml:"path_style"`
+}
+
 type Lotus struct {
 	NodeApi string `toml:"node_api"`
 	Wallet  string `toml:"wallet"`
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package rebuilder
+
+import (
+	"syscall"
+)
+
+// diskUsage returns the free bytes available to the user and the device id of the filesystem of path
+func diskUsage(path string) (free uint64, dev uint64, err error) {
+	var fs syscall.Statfs_t
+	if err = syscall.Statfs(path, &fs); err != nil {
+		return
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(path, &st); err != nil {
+		return
+	}
+	return uint64(fs.Bavail) * uint64(fs.Bsize), uint64(st.Dev), nil
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package rebuilder
+
+import (
+	"errors"
+)
+
+func diskUsage(path string) (free uint64, dev uint64, err error) {
+	return 0, 0, errors.New("disk usage not supported on windows")
+}
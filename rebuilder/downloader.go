@@ -1,44 +1,208 @@
 package rebuilder
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/FogMeta/rebuilder-tools/rebuilder/aria2"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
 	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/restore"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/s3"
+)
+
+var errNoURL = errors.New("no download url")
+
+// presignExpires is the expiry of presigned s3 urls, which covers the whole download of a car
+const presignExpires = 24 * time.Hour
+
+// aria2ControlSuffix is the suffix of the control file aria2 keeps beside a partial download
+const aria2ControlSuffix = ".aria2"
+
+// invalidSuffix is the suffix an existing car failing the checks is moved aside to, it is never removed
+const invalidSuffix = ".invalid"
+
+const (
+	DownloadStatusFailed  = -1
+	DownloadStatusWaiting = 0
+	DownloadStatusSuccess = 1
 )
 
 type DownloadInfo struct {
-	DirPath string
-	FileURL string
-	Gid     string
-	Status  int
-	Err     error
+	DirPath  string
+	FileURL  string
+	Mirrors  []string
+	FileName string
+	Car      *CarInfo
+	Gid      string
+	Attempts int
+	Status   int
+	Reused   bool // the car file was complete before downloading
+	Err      error
+	done     int64
+	total    int64
+	resolved []string
+	local    []string
+}
+
+// SetProgress is called by fetchers to report the downloaded and total bytes
+func (info *DownloadInfo) SetProgress(done, total int64) {
+	atomic.StoreInt64(&info.done, done)
+	atomic.StoreInt64(&info.total, total)
+}
+
+// AddProgress is called by fetchers to report n more bytes downloaded
+func (info *DownloadInfo) AddProgress(n int64) {
+	atomic.AddInt64(&info.done, n)
+}
+
+func (info *DownloadInfo) Progress() (done, total int64) {
+	return atomic.LoadInt64(&info.done), atomic.LoadInt64(&info.total)
+}
+
+// Path returns the path of the downloaded file
+func (info *DownloadInfo) Path() string {
+	return filepath.Join(info.DirPath, info.FileName)
+}
+
+// URLs returns FileURL followed by the mirrors, s3 urls are presigned by the downloader
+func (info *DownloadInfo) URLs() []string {
+	if info.resolved != nil {
+		return info.resolved
+	}
+	return append([]string{info.FileURL}, info.Mirrors...)
 }
 
 type Downloader struct {
-	total       int
-	maxNum      int
-	preChan     chan *DownloadInfo
-	inChan      chan *DownloadInfo
-	exit        chan bool
-	statusMap   map[string]*DownloadInfo
-	aria2Client *aria2.Client
+	maxNum    int
+	fetcher   Fetcher
+	retry     *RetryPolicy
+	keepGoing bool
+	progress  ProgressFunc
+	s3        *s3.Client
+	localMode string
+	complete  func(info *DownloadInfo)
+	prober    *HTTPFetcher // sends the HEAD requests probing the cars
 }
 
-func NewDownloader(max int, aria2Client *aria2.Client) *Downloader {
+func NewDownloader(max int, fetcher Fetcher) *Downloader {
+	if max <= 0 {
+		max = 1
+	}
 	return &Downloader{
-		maxNum:      max,
-		preChan:     make(chan *DownloadInfo, max),
-		inChan:      make(chan *DownloadInfo, max),
-		exit:        make(chan bool),
-		aria2Client: aria2Client,
+		maxNum:  max,
+		fetcher: fetcher,
+		retry:   DefaultRetryPolicy(),
+		prober:  NewHTTPFetcher(1),
+	}
+}
+
+// WithOptions sets the download options of the HEAD requests probing the names and sizes of the cars,
+// the fetcher is set with its own
+func (downloader *Downloader) WithOptions(options *config.Download) *Downloader {
+	downloader.prober = NewHTTPFetcher(1).WithOptions(options)
+	return downloader
+}
+
+func (downloader *Downloader) WithRetry(policy *RetryPolicy) *Downloader {
+	if policy != nil {
+		downloader.retry = policy
+	}
+	return downloader
+}
+
+// WithProgress sets the receiver of download progress events
+func (downloader *Downloader) WithProgress(fn ProgressFunc) *Downloader {
+	downloader.progress = fn
+	return downloader
+}
+
+// WithS3 sets the client to presign s3://bucket/key urls
+func (downloader *Downloader) WithS3(client *s3.Client) *Downloader {
+	downloader.s3 = client
+	return downloader
+}
+
+// WithLocalMode sets how file:// cars are placed in the dir, hardlink by default, see LocalModeHardlink
+func (downloader *Downloader) WithLocalMode(mode string) *Downloader {
+	downloader.localMode = mode
+	return downloader
+}
+
+// WithComplete sets the callback of each car downloaded and verified or reused, called by the download worker
+func (downloader *Downloader) WithComplete(fn func(info *DownloadInfo)) *Downloader {
+	downloader.complete = fn
+	return downloader
+}
+
+// WithKeepGoing sets whether to continue other downloads after one failed
+func (downloader *Downloader) WithKeepGoing(keepGoing bool) *Downloader {
+	downloader.keepGoing = keepGoing
+	return downloader
+}
+
+// DownloadFiles downloads fileURLs into dirPath, each url is one car file, see DownloadCars
+func (downloader *Downloader) DownloadFiles(ctx context.Context, dirPath string, fileURLs ...string) (status map[string]*DownloadInfo, err error) {
+	carInfos := make([]*CarInfo, 0, len(fileURLs))
+	for _, fileURL := range fileURLs {
+		carInfos = append(carInfos, &CarInfo{CarFileUrl: fileURL})
+	}
+	return downloader.DownloadCars(ctx, dirPath, carInfos...)
+}
+
+// uniqueCars returns the cars without the ones of duplicated first url, each car must have a url
+func uniqueCars(carInfos []*CarInfo) ([]*CarInfo, error) {
+	seen := make(map[string]bool, len(carInfos))
+	cars := make([]*CarInfo, 0, len(carInfos))
+	for _, car := range carInfos {
+		urls := car.URLs()
+		if len(urls) == 0 {
+			return nil, errors.New("car without download url")
+		}
+		if seen[urls[0]] {
+			continue
+		}
+		seen[urls[0]] = true
+		cars = append(cars, car)
+	}
+	return cars, nil
+}
+
+// parallelDo calls fn with each index below n from at most parallel goroutines, and returns after all are done
+func parallelDo(n, parallel int, fn func(i int)) {
+	if parallel <= 0 {
+		parallel = 1
+	}
+	if parallel > n {
+		parallel = n
+	}
+	next := int64(-1)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(atomic.AddInt64(&next, 1)); i < n; i = int(atomic.AddInt64(&next, 1)) {
+				fn(i)
+			}
+		}()
 	}
+	wg.Wait()
 }
 
-func (downloader *Downloader) DownloadFiles(dirPath string, fileURLs ...string) (status map[string]*DownloadInfo, err error) {
+// DownloadCars downloads car files into dirPath with at most maxNum jobs in flight,
+// each car is one download from its url and mirrors, status is keyed by CarFileUrl
+// and records the file name derived by carFileNames.
+// Jobs are dispatched in the order of carInfos and retried by the retry policy.
+// The first failure stops dispatching unless keep going, which downloads all the others
+// and reports the failures by the Err of each DownloadInfo in status.
+// Canceling ctx stops dispatching and removes the in-flight downloads
+func (downloader *Downloader) DownloadCars(ctx context.Context, dirPath string, carInfos ...*CarInfo) (status map[string]*DownloadInfo, err error) {
 	info, err := os.Stat(dirPath)
 	if err != nil {
 		return
@@ -46,102 +210,292 @@ func (downloader *Downloader) DownloadFiles(dirPath string, fileURLs ...string)
 	if !info.IsDir() {
 		return nil, errors.New("dir path is not a directory")
 	}
-	downloader.total = len(fileURLs)
-	downloader.statusMap = make(map[string]*DownloadInfo, downloader.total)
-	for _, fileURL := range fileURLs {
+	carInfos, err = uniqueCars(carInfos)
+	if err != nil {
+		return
+	}
+	names := carFileNames(ctx, downloader.prober, downloader.maxNum, carInfos)
+	status = make(map[string]*DownloadInfo, len(carInfos))
+	infos := make([]*DownloadInfo, 0, len(carInfos))
+	for i, car := range carInfos {
+		urls := car.URLs()
 		info := &DownloadInfo{
-			DirPath: dirPath,
-			FileURL: fileURL,
+			DirPath:  dirPath,
+			FileURL:  urls[0],
+			Mirrors:  urls[1:],
+			FileName: names[i],
+			Car:      car,
 		}
-		downloader.statusMap[fileURL] = info
+		log.Debugf("download %s to %s", info.FileURL, info.Path())
+		status[info.FileURL] = info
+		infos = append(infos, info)
 	}
 
-	go func(dirPath string, fileURLs ...string) {
-		i := 0
-		for {
-			if i >= len(fileURLs) {
-				log.Info("send download finished")
-				return
+	workers := downloader.maxNum
+	if workers > len(infos) {
+		workers = len(infos)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobChan := make(chan *DownloadInfo)
+	var once sync.Once
+	stop := func(e error) {
+		once.Do(func() {
+			err = e
+			cancel()
+		})
+	}
+
+	if downloader.progress != nil {
+		go downloader.reportProgress(ctx, infos)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for info := range jobChan {
+				if e := downloader.download(ctx, info); e != nil && !downloader.keepGoing {
+					stop(e)
+					return
+				}
 			}
-			fileURL := fileURLs[i]
+		}()
+	}
+
+	go func() {
+		defer close(jobChan)
+		for _, info := range infos {
 			select {
-			case <-downloader.exit:
+			case <-ctx.Done():
 				return
-			case downloader.preChan <- downloader.statusMap[fileURL]:
-				i++
+			case jobChan <- info:
 			}
 		}
-	}(dirPath, fileURLs...)
-	err = downloader.checkDownload()
-	return downloader.statusMap, err
+		log.Info("send download finished")
+	}()
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return
+	}
+	failed, reused := 0, 0
+	for _, info := range infos {
+		if info.Reused {
+			reused++
+		}
+		if info.Status != DownloadStatusSuccess {
+			failed++
+			log.Errorf("download %s failed: %v", info.FileURL, info.Err)
+		}
+	}
+	if reused > 0 {
+		log.Infof("reused %d of %d existing car files", reused, len(infos))
+	}
+	if failed > 0 {
+		return status, fmt.Errorf("%d of %d downloads failed", failed, len(infos))
+	}
+	log.Info("download finished")
+	return
 }
 
-func (downloader *Downloader) checkDownload() error {
-	ticker := time.NewTicker(1 * time.Second)
-	var temp []*DownloadInfo
-	finishChan := make(chan bool)
-	go func() {
-		finishChan <- true // start the download
-	}()
-	exit := false
-	defer func() {
-		if !exit {
-			close(downloader.exit)
+func (downloader *Downloader) download(ctx context.Context, info *DownloadInfo) (err error) {
+	if downloader.reuse(ctx, info) {
+		info.Status = DownloadStatusSuccess
+		info.Reused = true
+		downloader.finish(info, nil)
+		return
+	}
+	policy := downloader.retry
+	for info.Attempts = 1; ; info.Attempts++ {
+		log.Info("start download job :", info.FileURL)
+		if err = downloader.fetch(ctx, info); err == nil {
+			info.Status = DownloadStatusSuccess
+			info.Err = nil
+			downloader.finish(info, nil)
+			return
 		}
-	}()
-	errExit := errors.New("exit")
+		if ctx.Err() != nil {
+			return
+		}
+		info.Status = DownloadStatusFailed
+		info.Err = err
+		if info.Attempts >= policy.Attempts || !policy.Retryable(err) {
+			downloader.finish(info, err)
+			return
+		}
+		delay := policy.Delay(info.Attempts)
+		log.Warnf("download %s failed: %v, retry %d/%d after %s", info.FileURL, err, info.Attempts, policy.Attempts-1, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reuse checks whether the car file is already downloaded and verified by a previous run,
+// a file with aria2 control file is partial and resumed by fetch, an unverified file is moved aside to .invalid
+func (downloader *Downloader) reuse(ctx context.Context, info *DownloadInfo) bool {
+	path := info.Path()
+	stat, err := os.Stat(path)
+	if err != nil || stat.IsDir() {
+		return false
+	}
+	if _, err = os.Stat(path + aria2ControlSuffix); err == nil {
+		log.Info("resume partial download :", path)
+		return false
+	}
+	if err = VerifyCar(path, info.Car); err == nil {
+		err = verifyComplete(ctx, downloader.prober, path, stat.Size(), info)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		log.Warnf("existing car %s not reused, moved to %s: %v", path, path+invalidSuffix, err)
+		if e := os.Rename(path, path+invalidSuffix); e != nil {
+			log.Warn("move unverified car failed: ", e)
+		}
+		return false
+	}
+	log.Info("reuse existing car :", path)
+	info.SetProgress(stat.Size(), stat.Size())
+	return true
+}
+
+// verifyComplete checks the existing car without size, sha256 or piece cid in metadata is not truncated,
+// by the content length of its urls if known, or by reading the sections of all its blocks
+func verifyComplete(ctx context.Context, prober *HTTPFetcher, path string, size int64, info *DownloadInfo) error {
+	if info.Car.CarFileSize > 0 || info.Car.CarFileSha256 != "" || info.Car.PieceCid != "" {
+		// verified by VerifyCar
+		return nil
+	}
+	if expected := probeSize(ctx, prober, info.URLs()); expected > 0 {
+		if size != expected {
+			return &VerifyError{path, fmt.Sprintf("size %d not matched content length %d", size, expected)}
+		}
+		return nil
+	}
+	if err := restore.CheckCar(ctx, path); err != nil {
+		return &VerifyError{path, err.Error()}
+	}
+	return nil
+}
+
+// fetch downloads and verifies the car file, the file is removed if not verified
+func (downloader *Downloader) fetch(ctx context.Context, info *DownloadInfo) error {
+	if err := downloader.resolve(info); err != nil {
+		return err
+	}
+	// local files first, then the remote urls
+	err := errNoURL
+	if len(info.local) > 0 {
+		err = downloader.fetchLocal(ctx, info)
+	}
+	if err != nil && len(info.URLs()) > 0 {
+		err = downloader.fetcher.Fetch(ctx, info)
+	}
+	if err != nil {
+		return err
+	}
+	path := info.Path()
+	if err := VerifyCar(path, info.Car); err != nil {
+		if e := os.Remove(path); e != nil {
+			log.Warn("remove unverified car failed: ", e)
+		}
+		return err
+	}
+	return nil
+}
+
+// resolve splits the local paths of file:// urls from the remote urls of info,
+// and presigns the s3 urls for each try, so the signatures not expire on retry
+func (downloader *Downloader) resolve(info *DownloadInfo) error {
+	urls := append([]string{info.FileURL}, info.Mirrors...)
+	resolved := make([]string, 0, len(urls))
+	info.local = nil
+	presigned := false
+	for _, fileURL := range urls {
+		path, ok, err := localPath(fileURL)
+		if err != nil {
+			return err
+		}
+		if ok {
+			info.local = append(info.local, path)
+			continue
+		}
+		bucket, key, ok := s3.ParseURL(fileURL)
+		if !ok {
+			resolved = append(resolved, fileURL)
+			continue
+		}
+		if downloader.s3 == nil {
+			return &noS3Error{fileURL}
+		}
+		signedURL, err := downloader.s3.Presign(bucket, key, presignExpires)
+		if err != nil {
+			return err
+		}
+		resolved = append(resolved, signedURL)
+		presigned = true
+	}
+	if presigned || len(info.local) > 0 {
+		info.resolved = resolved
+	}
+	return nil
+}
+
+// noS3Error is returned for s3 urls without s3 config, which is not retryable
+type noS3Error struct {
+	URL string
+}
+
+func (e *noS3Error) Error() string {
+	return "conf not set s3 for url: " + e.URL
+}
+
+// reportProgress reports the progress of started downloads periodically until ctx done
+func (downloader *Downloader) reportProgress(ctx context.Context, infos []*DownloadInfo) {
+	meters := make(map[*DownloadInfo]*speedometer)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-finishChan:
-			if downloader.total == 0 {
-				log.Info("download finished")
-				return nil
-			}
-			info := <-downloader.preChan
-			log.Info("start download job :", info.FileURL)
-			info.Gid, info.Err = downloader.downloadFile(info.DirPath, info.FileURL, ".car")
-			if info.Err != nil {
-				return info.Err
-			}
-			log.Info("download gid :", info.Gid)
-			downloader.inChan <- info
-		case info := <-downloader.inChan:
-			ok, err := downloader.downloadStatus(info.Gid)
-			if !ok && err == nil {
-				temp = append(temp, info)
-				break
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, info := range infos {
+			done, total := info.Progress()
+			if done == 0 && total == 0 {
+				continue
 			}
-			if err != nil {
-				info.Status = -1
-				info.Err = err
-				return err
+			meter, ok := meters[info]
+			if !ok {
+				meter = new(speedometer)
+				meters[info] = meter
 			}
-			info.Status = 1
-			downloader.total--
-			go func() {
-				finishChan <- true
-			}()
-		case <-ticker.C:
-			log.Info("ticker query number: ", len(temp))
-			for _, info := range temp {
-				downloader.inChan <- info
+			p := Progress{Stage: StageDownload, Job: info.FileURL, Done: done, Total: total}
+			meter.update(&p)
+			if done < total || total == 0 {
+				downloader.progress(p)
 			}
-			temp = temp[:0]
-		case <-downloader.exit:
-			exit = true
-			return errExit
 		}
 	}
 }
 
-func (downloader *Downloader) downloadFile(dirPath string, fileURL string, format ...string) (gid string, err error) {
-	name := filepath.Base(fileURL)
-	if len(format) > 0 {
-		name += format[0]
+func (downloader *Downloader) finish(info *DownloadInfo, err error) {
+	if downloader.progress != nil {
+		done, total := info.Progress()
+		downloader.progress(Progress{Stage: StageDownload, Job: info.FileURL, Done: done, Total: total, Finished: true, Err: err})
+	}
+	if err == nil && downloader.complete != nil {
+		downloader.complete(info)
 	}
-	return downloader.aria2Client.DownloadFile(fileURL, dirPath, name)
-}
-
-func (downloader *Downloader) downloadStatus(gid string) (ok bool, err error) {
-	return downloader.aria2Client.DownloadStatus(gid)
 }
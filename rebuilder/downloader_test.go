@@ -0,0 +1,233 @@
+package rebuilder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fetcherFunc is a Fetcher calling the func
+type fetcherFunc func(ctx context.Context, info *DownloadInfo) error
+
+func (fn fetcherFunc) Fetch(ctx context.Context, info *DownloadInfo) error {
+	return fn(ctx, info)
+}
+
+func testCars(n int) (cars []*CarInfo) {
+	for i := 0; i < n; i++ {
+		cars = append(cars, &CarInfo{CarFileUrl: fmt.Sprintf("http://a.example.com/%d.car", i)})
+	}
+	return
+}
+
+// TestDownloadCarsParallel downloads the cars with at most maxNum fetches in flight, the fetches wait
+// for each other until maxNum are in flight so an unbounded pool runs more
+func TestDownloadCarsParallel(t *testing.T) {
+	dag, root, _ := testPayload(t)
+	data := carData(t, dag, root.Cid(), nil)
+	tests := []struct {
+		name   string
+		maxNum int
+		cars   int
+		want   int
+	}{
+		{"one", 1, 4, 1},
+		{"bounded", 2, 6, 2},
+		{"more workers than cars", 8, 3, 3},
+		{"not set", 0, 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			inflight, max := 0, 0
+			all := make(chan struct{})
+			fetcher := fetcherFunc(func(ctx context.Context, info *DownloadInfo) error {
+				mu.Lock()
+				inflight++
+				if inflight > max {
+					max = inflight
+				}
+				if max == tt.want {
+					select {
+					case <-all:
+					default:
+						close(all)
+					}
+				}
+				mu.Unlock()
+				select {
+				case <-all:
+				case <-time.After(time.Second):
+				}
+				// let the other fetches in if the pool is not bounded
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				inflight--
+				mu.Unlock()
+				return os.WriteFile(info.Path(), data, 0644)
+			})
+			status, err := NewDownloader(tt.maxNum, fetcher).DownloadCars(context.Background(), t.TempDir(), testCars(tt.cars)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(status) != tt.cars {
+				t.Fatalf("%d downloads, want %d", len(status), tt.cars)
+			}
+			for url, info := range status {
+				if info.Status != DownloadStatusSuccess {
+					t.Fatalf("download %s status %v", url, info.Status)
+				}
+			}
+			if max != tt.want {
+				t.Fatalf("max fetches in flight %d, want %d", max, tt.want)
+			}
+		})
+	}
+}
+
+// TestDownloadRetry retries the temporary failures of a car by the retry policy
+func TestDownloadRetry(t *testing.T) {
+	dag, root, _ := testPayload(t)
+	data := carData(t, dag, root.Cid(), nil)
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		attempts int
+		success  bool
+	}{
+		{"first try", 0, nil, 1, true},
+		{"retried", 2, &HTTPStatusError{Code: 503}, 3, true},
+		{"attempts used up", 3, &HTTPStatusError{Code: 503}, 3, false},
+		{"not retryable", 1, &HTTPStatusError{Code: 404}, 1, false},
+		{"not verified retried", 1, nil, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches int
+			fetcher := fetcherFunc(func(ctx context.Context, info *DownloadInfo) error {
+				fetches++
+				if fetches <= tt.failures {
+					if tt.err != nil {
+						return tt.err
+					}
+					// a fetched file failing the verification
+					return os.WriteFile(info.Path(), []byte("not a car"), 0644)
+				}
+				return os.WriteFile(info.Path(), data, 0644)
+			})
+			policy := &RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+			downloader := NewDownloader(1, fetcher).WithRetry(policy)
+			info := &DownloadInfo{DirPath: t.TempDir(), FileURL: "http://a.example.com/a.car", FileName: "a.car", Car: &CarInfo{}}
+			err := downloader.download(context.Background(), info)
+			if (err == nil) != tt.success || (info.Status == DownloadStatusSuccess) != tt.success {
+				t.Fatalf("download error %v status %d, want success %v", err, info.Status, tt.success)
+			}
+			if info.Attempts != tt.attempts || fetches != tt.attempts {
+				t.Fatalf("attempts %d fetches %d, want %d", info.Attempts, fetches, tt.attempts)
+			}
+			if !tt.success && !errors.Is(info.Err, err) {
+				t.Fatalf("info error %v, want %v", info.Err, err)
+			}
+		})
+	}
+}
+
+// TestDownloadCarsKeepGoing stops at the first failed car unless keep going, which downloads all the others
+// and reports the failed ones in status
+func TestDownloadCarsKeepGoing(t *testing.T) {
+	dag, root, _ := testPayload(t)
+	data := carData(t, dag, root.Cid(), nil)
+	notFound := &HTTPStatusError{Code: 404}
+	tests := []struct {
+		name       string
+		keepGoing  bool
+		downloaded int
+	}{
+		{"stop", false, 1},
+		{"keep going", true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cars := testCars(4)
+			failed := cars[1].CarFileUrl
+			fetcher := fetcherFunc(func(ctx context.Context, info *DownloadInfo) error {
+				if info.FileURL == failed {
+					return notFound
+				}
+				return os.WriteFile(info.Path(), data, 0644)
+			})
+			downloader := NewDownloader(1, fetcher).WithKeepGoing(tt.keepGoing)
+			status, err := downloader.DownloadCars(context.Background(), t.TempDir(), cars...)
+			if tt.keepGoing {
+				if err == nil || errors.Is(err, notFound) {
+					t.Fatalf("error %v, want failed downloads", err)
+				}
+			} else if !errors.Is(err, notFound) {
+				t.Fatalf("error %v, want %v", err, notFound)
+			}
+			downloaded := 0
+			for _, info := range status {
+				if info.Status == DownloadStatusSuccess {
+					downloaded++
+				}
+			}
+			if downloaded != tt.downloaded {
+				t.Fatalf("%d downloaded, want %d", downloaded, tt.downloaded)
+			}
+			if info := status[failed]; info.Status != DownloadStatusFailed || !errors.Is(info.Err, notFound) {
+				t.Fatalf("failed download status %d error %v", info.Status, info.Err)
+			}
+		})
+	}
+}
+
+// TestReuseExisting reuses the existing cars passing the checks, the others are moved aside to .invalid
+// with their data kept
+func TestReuseExisting(t *testing.T) {
+	dag, root, _ := testPayload(t)
+	data := carData(t, dag, root.Cid(), nil)
+	tests := []struct {
+		name  string
+		data  []byte
+		car   *CarInfo
+		reuse bool
+	}{
+		{"verified", data, &CarInfo{CarFileSize: int64(len(data)), CID: root.Cid().String()}, true},
+		{"complete blocks", data, &CarInfo{}, true},
+		{"size not matched", data, &CarInfo{CarFileSize: int64(len(data)) + 1}, false},
+		{"truncated", data[:len(data)-10], &CarInfo{}, false},
+		{"not car", []byte("not a car"), &CarInfo{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &DownloadInfo{DirPath: t.TempDir(), FileName: "a.car", Car: tt.car}
+			if err := os.WriteFile(info.Path(), tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if reused := NewDownloader(1, nil).reuse(context.Background(), info); reused != tt.reuse {
+				t.Fatalf("reused %v, want %v", reused, tt.reuse)
+			}
+			path := info.Path()
+			if !tt.reuse {
+				path += invalidSuffix
+				if _, err := os.Stat(info.Path()); !os.IsNotExist(err) {
+					t.Fatalf("invalid car left at its path: %v", err)
+				}
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Fatalf("car at %s changed", filepath.Base(path))
+			}
+		})
+	}
+}
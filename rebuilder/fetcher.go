@@ -0,0 +1,178 @@
+package rebuilder
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/aria2"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+)
+
+const (
+	FetcherAria2 = "aria2"
+	FetcherHTTP  = "http"
+)
+
+const (
+	pollInterval = 2 * time.Second
+	// status polling is only a fallback when notified by aria2 websocket
+	notifiedPollInterval = 15 * time.Second
+	// consecutive failed status queries before the download is removed and failed
+	maxStatusErrors = 5
+)
+
+// Fetcher downloads info.FileURL or its mirrors to info.DirPath/info.FileName, blocks until the file is complete
+type Fetcher interface {
+	Fetch(ctx context.Context, info *DownloadInfo) error
+}
+
+// Aria2Fetcher downloads files by aria2 rpc
+type Aria2Fetcher struct {
+	client   *aria2.Client
+	mu       sync.Mutex
+	watchers map[string]chan struct{}
+	options  *config.Download
+}
+
+func NewAria2Fetcher(client *aria2.Client) *Aria2Fetcher {
+	fetcher := &Aria2Fetcher{
+		client:   client,
+		watchers: make(map[string]chan struct{}),
+	}
+	if events, _ := client.Subscribe(); events != nil {
+		go fetcher.dispatch(events)
+	}
+	return fetcher
+}
+
+// interval returns the status polling interval, polling is only a fallback while notified by aria2 websocket
+func (fetcher *Aria2Fetcher) interval() time.Duration {
+	if fetcher.client.Notified() {
+		return notifiedPollInterval
+	}
+	return pollInterval
+}
+
+// WithOptions sets the aria2 options of each download, the mirrors of hosts with different options
+// are downloaded one group after another instead of together
+func (fetcher *Aria2Fetcher) WithOptions(options *config.Download) *Aria2Fetcher {
+	fetcher.options = options
+	return fetcher
+}
+
+// Fetch downloads from the mirrors of each group of the same options in turn until one succeeds
+func (fetcher *Aria2Fetcher) Fetch(ctx context.Context, info *DownloadInfo) (err error) {
+	groups := groupMirrors(fetcher.options, info.URLs())
+	for i, group := range groups {
+		if err = fetcher.fetch(ctx, info, group); err == nil || ctx.Err() != nil {
+			return
+		}
+		if i < len(groups)-1 {
+			log.Warnf("download %s failed: %v, try the next mirrors", redactURL(group.urls[0]), err)
+		}
+	}
+	return
+}
+
+// fetch downloads from the mirrors of group together by one aria2 download
+func (fetcher *Aria2Fetcher) fetch(ctx context.Context, info *DownloadInfo, group *mirrorGroup) (err error) {
+	info.Gid, err = fetcher.client.DownloadURIs(group.urls, info.DirPath, info.FileName, aria2DownloadOption(group.opts, info.Car))
+	if err != nil {
+		return
+	}
+	log.Info("download gid :", info.Gid)
+
+	notified := fetcher.watch(info.Gid)
+	defer fetcher.unwatch(info.Gid)
+	timer := time.NewTimer(fetcher.interval())
+	defer timer.Stop()
+	statusErrors := 0
+	for {
+		select {
+		case <-ctx.Done():
+			fetcher.remove(info.Gid)
+			return ctx.Err()
+		case <-notified:
+		case <-timer.C:
+		}
+		// the interval changes while the websocket is redialing
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(fetcher.interval())
+		result, ok, err := fetcher.client.DownloadState(info.Gid)
+		if result != nil {
+			info.SetProgress(result.Lengths())
+		}
+		if err != nil {
+			var downloadErr *aria2.DownloadError
+			if !errors.As(err, &downloadErr) && statusErrors < maxStatusErrors {
+				// rpc timeout, websocket drop or invalid response, the download may still be running
+				statusErrors++
+				log.Warnf("query aria2 download %s failed (%d/%d): %v", info.Gid, statusErrors, maxStatusErrors, err)
+				continue
+			}
+			// the retry adds the url again, no job is left in aria2 writing the same file
+			fetcher.remove(info.Gid)
+			return err
+		}
+		statusErrors = 0
+		if ok {
+			return nil
+		}
+	}
+}
+
+// remove stops the download if active, and removes its result from aria2
+func (fetcher *Aria2Fetcher) remove(gid string) {
+	if status, err := fetcher.client.TellStatus(gid, "status"); err == nil {
+		if status.Status == aria2.StatusActive || status.Status == aria2.StatusWaiting || status.Status == aria2.StatusPaused {
+			if err = fetcher.client.ForceRemove(gid); err != nil {
+				log.Warnf("remove aria2 download %s failed: %v", gid, err)
+				return
+			}
+		}
+	}
+	if err := fetcher.client.RemoveDownloadResult(gid); err != nil {
+		log.Debugf("remove aria2 download result %s failed: %v", gid, err)
+	}
+}
+
+// dispatch wakes up the job waiting for the gid of each aria2 notification
+func (fetcher *Aria2Fetcher) dispatch(events <-chan aria2.Notification) {
+	for event := range events {
+		log.Debugf("aria2 notification %s gid: %s", event.Method, event.Gid)
+		fetcher.mu.Lock()
+		ch, ok := fetcher.watchers[event.Gid]
+		fetcher.mu.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (fetcher *Aria2Fetcher) watch(gid string) <-chan struct{} {
+	// pre-filled to query the status at once, then woken up by notifications of the gid
+	ch := make(chan struct{}, 1)
+	ch <- struct{}{}
+	fetcher.mu.Lock()
+	fetcher.watchers[gid] = ch
+	fetcher.mu.Unlock()
+	return ch
+}
+
+func (fetcher *Aria2Fetcher) unwatch(gid string) {
+	fetcher.mu.Lock()
+	delete(fetcher.watchers, gid)
+	fetcher.mu.Unlock()
+}
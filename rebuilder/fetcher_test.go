@@ -0,0 +1,137 @@
+package rebuilder
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/aria2"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+)
+
+// aria2Download is a download added to the stand-in aria2
+type aria2Download struct {
+	uris   []string
+	option aria2.DownloadOption
+}
+
+// testAria2 is a stand-in aria2 rpc server, the downloads added fail with status error until the uris of
+// a download hold complete, which completes at once by writing the file
+type testAria2 struct {
+	mu        sync.Mutex
+	complete  string
+	downloads []aria2Download
+}
+
+func newTestAria2(t *testing.T, complete string) (*testAria2, *aria2.Client) {
+	t.Helper()
+	server := &testAria2{complete: complete}
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return server, aria2.NewClient(host, p, "")
+}
+
+func (server *testAria2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Id     string            `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Params) < 2 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	var result interface{} = "OK"
+	switch req.Method {
+	case "aria2.addUri":
+		var download aria2Download
+		json.Unmarshal(req.Params[1], &download.uris)
+		if len(req.Params) > 2 {
+			json.Unmarshal(req.Params[2], &download.option)
+		}
+		server.downloads = append(server.downloads, download)
+		result = strconv.Itoa(len(server.downloads))
+	case "aria2.tellStatus":
+		var gid string
+		json.Unmarshal(req.Params[1], &gid)
+		index, _ := strconv.Atoi(gid)
+		if index < 1 || index > len(server.downloads) {
+			http.Error(w, "invalid gid", http.StatusBadRequest)
+			return
+		}
+		download := server.downloads[index-1]
+		path := filepath.Join(download.option.Dir, download.option.Out)
+		status := &aria2.StatusResult{Gid: gid, Status: aria2.StatusError, ErrorCode: "3", ErrorMessage: "not found",
+			Files: []aria2.Aria2StatusResultFile{{Path: path}}}
+		for _, uri := range download.uris {
+			if uri == server.complete {
+				status.Status, status.ErrorCode, status.ErrorMessage = aria2.StatusComplete, "", ""
+				os.WriteFile(path, []byte(uri), 0644)
+			}
+		}
+		result = status
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": req.Id, "jsonrpc": "2.0", "result": result})
+}
+
+// TestAria2FetchMirrorHosts fetches a car from the mirrors of two hosts, the mirrors of the host with its own
+// headers and limit are added to aria2 as another download, the first failing so the second is added
+func TestAria2FetchMirrorHosts(t *testing.T) {
+	const (
+		a1 = "http://a.example.com/1.car"
+		a2 = "http://a.example.com/2.car"
+		b1 = "http://b.example.com/1.car"
+	)
+	server, client := newTestAria2(t, b1)
+	conf := &config.Download{
+		DownloadOptions: config.DownloadOptions{Headers: []string{"X-Global: 1"}},
+		Hosts: []*config.DownloadHost{{
+			Host:            "a.example.com",
+			DownloadOptions: config.DownloadOptions{Headers: []string{"X-Token: secret"}, MaxDownloadLimit: "1M"},
+		}},
+	}
+	fetcher := NewAria2Fetcher(client).WithOptions(conf)
+	info := &DownloadInfo{FileURL: a1, Mirrors: []string{b1, a2}, DirPath: t.TempDir(), FileName: "a.car"}
+	if err := fetcher.Fetch(context.Background(), info); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uris    []string
+		headers []string
+		limit   string
+	}{
+		{[]string{a1, a2}, []string{"X-Global: 1", "X-Token: secret"}, "1M"},
+		{[]string{b1}, []string{"X-Global: 1"}, ""},
+	}
+	if len(server.downloads) != len(tests) {
+		t.Fatalf("downloads added %d, want %d", len(server.downloads), len(tests))
+	}
+	for i, tt := range tests {
+		download := server.downloads[i]
+		if !reflect.DeepEqual(download.uris, tt.uris) {
+			t.Errorf("download %d uris %v, want %v", i, download.uris, tt.uris)
+		}
+		if !reflect.DeepEqual(download.option.Header, tt.headers) {
+			t.Errorf("download %d headers %v, want %v", i, download.option.Header, tt.headers)
+		}
+		if download.option.MaxDownloadLimit != tt.limit {
+			t.Errorf("download %d limit %q, want %q", i, download.option.MaxDownloadLimit, tt.limit)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package rebuilder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+)
+
+const (
+	carExt         = ".car"
+	maxNameLength  = 128
+	urlHashLength  = 8
+	defaultCarName = "car"
+)
+
+// carFileNames returns the file name of each car, de-duplicated by a numeric suffix in the order of carInfos,
+// the urls are probed by prober from at most parallel goroutines
+func carFileNames(ctx context.Context, prober *HTTPFetcher, parallel int, carInfos []*CarInfo) []string {
+	names := make([]string, len(carInfos))
+	parallelDo(len(carInfos), parallel, func(i int) {
+		names[i] = carFileName(ctx, prober, carInfos[i])
+	})
+	used := make(map[string]bool, len(carInfos))
+	for i, name := range names {
+		base := strings.TrimSuffix(name, carExt)
+		for n := 1; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s-%d%s", base, n, carExt)
+		}
+		used[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+// carFileName derives the file name of car from the piece cid or payload cid in metadata,
+// then the url path, then the Content-Disposition of the url if the url has query,
+// the url hash is appended if the name is not unique to the url
+func carFileName(ctx context.Context, prober *HTTPFetcher, car *CarInfo) string {
+	if name := sanitizeName(car.PieceCid); name != "" {
+		return name + carExt
+	}
+	if name := sanitizeName(car.CID); name != "" {
+		return name + carExt
+	}
+	urls := car.URLs()
+	if len(urls) == 0 {
+		return defaultCarName + carExt
+	}
+	fileURL := urls[0]
+	var base string
+	u, err := url.Parse(fileURL)
+	if err == nil {
+		base = sanitizeName(path.Base(u.Path))
+		if u.RawQuery == "" && base != "" {
+			return base + carExt
+		}
+	}
+	if name := contentDispositionName(ctx, prober, fileURL); name != "" {
+		return name + carExt
+	}
+	if base == "" {
+		base = defaultCarName
+	}
+	sum := sha256.Sum256([]byte(fileURL))
+	return base + "-" + hex.EncodeToString(sum[:])[:urlHashLength] + carExt
+}
+
+// sanitizeName keeps letters, digits, '.', '-' and '_' of name and strips the .car extensions
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	for {
+		trimmed := strings.Trim(name, "._")
+		if lower := strings.ToLower(trimmed); strings.HasSuffix(lower, carExt) {
+			trimmed = trimmed[:len(trimmed)-len(carExt)]
+		}
+		if trimmed == name {
+			break
+		}
+		name = trimmed
+	}
+	if len(name) > maxNameLength {
+		name = name[:maxNameLength]
+	}
+	return name
+}
+
+// contentDispositionName returns the sanitized filename in the Content-Disposition of a HEAD request to fileURL by prober
+func contentDispositionName(ctx context.Context, prober *HTTPFetcher, fileURL string) string {
+	if !strings.HasPrefix(fileURL, "http://") && !strings.HasPrefix(fileURL, "https://") {
+		return ""
+	}
+	resp, err := prober.head(ctx, fileURL)
+	if err != nil {
+		log.Debugf("head %s failed: %v", redactURL(fileURL), err)
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return sanitizeName(path.Base(params["filename"]))
+}
@@ -0,0 +1,120 @@
+package rebuilder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+)
+
+// urlHash returns the url hash appended to the names not unique to the url
+func urlHash(fileURL string) string {
+	sum := sha256.Sum256([]byte(fileURL))
+	return hex.EncodeToString(sum[:])[:urlHashLength]
+}
+
+func TestCarFileNames(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if name := r.URL.Query().Get("name"); name != "" {
+			w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		}
+	}))
+	defer srv.Close()
+	prober := NewHTTPFetcher(1).WithOptions(&config.Download{Hosts: []*config.DownloadHost{{
+		Host:            "127.0.0.1",
+		DownloadOptions: config.DownloadOptions{Headers: []string{"X-Token: secret"}},
+	}}})
+
+	tests := []struct {
+		name string
+		cars []*CarInfo
+		want []string
+	}{
+		{
+			name: "metadata",
+			cars: []*CarInfo{{PieceCid: "baga1", CID: "bafy1"}, {CID: "bafy2"}, {CarFileUrl: "http://a.example.com/dir/x.car"}},
+			want: []string{"baga1.car", "bafy2.car", "x.car"},
+		},
+		{
+			name: "collisions",
+			cars: []*CarInfo{
+				{CarFileUrl: "http://a.example.com/x.car"},
+				{CarFileUrl: "http://b.example.com/x.car"},
+				{CarFileUrl: "http://c.example.com/X.car"},
+				{CarFileUrl: "http://d.example.com/x-1.car"},
+			},
+			want: []string{"x.car", "x-1.car", "X-2.car", "x-1-1.car"},
+		},
+		{
+			name: "sanitized",
+			cars: []*CarInfo{{CarFileUrl: "http://a.example.com/a%20b.car.car"}, {PieceCid: "../.."}, {}, {}},
+			want: []string{"a_b.car", "car.car", "car-1.car", "car-2.car"},
+		},
+		{
+			name: "content disposition",
+			cars: []*CarInfo{
+				{CarFileUrl: srv.URL + "/download?name=y.car"},
+				{CarFileUrl: srv.URL + "/download?name=../y.car"},
+				{CarFileUrl: srv.URL + "/download?id=1"},
+			},
+			want: []string{"y.car", "y-1.car", "download-" + urlHash(srv.URL+"/download?id=1") + ".car"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := carFileNames(context.Background(), prober, 2, tt.cars); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("names %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCarFileNamesParallel probes the names of the cars from parallel goroutines
+func TestCarFileNamesParallel(t *testing.T) {
+	const parallel = 3
+	var mu sync.Mutex
+	inflight, max := 0, 0
+	all := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inflight++
+		if inflight > max {
+			max = inflight
+		}
+		if max == parallel {
+			select {
+			case <-all:
+			default:
+				close(all)
+			}
+		}
+		mu.Unlock()
+		select {
+		case <-all:
+		case <-time.After(5 * time.Second):
+		}
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	var cars []*CarInfo
+	for i := 0; i < 2*parallel; i++ {
+		cars = append(cars, &CarInfo{CarFileUrl: srv.URL + "/download?id=" + string(rune('a'+i))})
+	}
+	carFileNames(context.Background(), NewHTTPFetcher(1), parallel, cars)
+	if max != parallel {
+		t.Fatalf("max probes in flight %d, want %d", max, parallel)
+	}
+}
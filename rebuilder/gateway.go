@@ -0,0 +1,213 @@
+package rebuilder
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+)
+
+const (
+	ipfsScheme      = "ipfs://"
+	carContentType  = "application/vnd.ipld.car"
+	gatewayTimeout  = 30 * time.Minute
+	carWriterBuffer = 1 << 20
+)
+
+// GatewayFetcher downloads the car of the payload cid from IPFS trustless gateways, each block is
+// verified against its cid as it streams, gateways are tried in order until one succeeds
+type GatewayFetcher struct {
+	client   *http.Client
+	gateways []string
+}
+
+func NewGatewayFetcher(gateways []string, timeout ...time.Duration) *GatewayFetcher {
+	client := &http.Client{Timeout: gatewayTimeout}
+	if len(timeout) > 0 && timeout[0] > 0 {
+		client.Timeout = timeout[0]
+	}
+	fetcher := &GatewayFetcher{client: client}
+	for _, gateway := range gateways {
+		if gateway = strings.TrimRight(strings.TrimSpace(gateway), "/"); gateway != "" {
+			fetcher.gateways = append(fetcher.gateways, gateway)
+		}
+	}
+	return fetcher
+}
+
+// newGatewayFetcher returns the fetcher of the gateways in conf, nil if no gateway set
+func newGatewayFetcher(conf *config.Config) *GatewayFetcher {
+	if conf.Gateway == nil || len(conf.Gateway.URLs) == 0 {
+		return nil
+	}
+	return NewGatewayFetcher(conf.Gateway.URLs, time.Duration(conf.Gateway.Timeout)*time.Second)
+}
+
+// gatewayRouter fetches the ipfs://<PayloadCid> cars from the gateways, and the others by fetcher
+type gatewayRouter struct {
+	fetcher Fetcher
+	gateway *GatewayFetcher
+}
+
+func (router *gatewayRouter) Fetch(ctx context.Context, info *DownloadInfo) error {
+	if strings.HasPrefix(info.FileURL, ipfsScheme) {
+		return router.gateway.Fetch(ctx, info)
+	}
+	return router.fetcher.Fetch(ctx, info)
+}
+
+// gatewaySource downloads the cars of the payload cids of the job from the gateways, the car urls are not used
+type gatewaySource struct {
+	*downloadSource
+}
+
+// newGatewaySource returns the source downloading from the gateways of conf
+func newGatewaySource(conf *config.Config) (Source, error) {
+	fetcher := newGatewayFetcher(conf)
+	if fetcher == nil {
+		return nil, errors.New("conf not set gateway")
+	}
+	download, err := newDownloadSource(conf, fetcher)
+	if err != nil {
+		return nil, err
+	}
+	return gatewaySource{download}, nil
+}
+
+func (source gatewaySource) Cars(ctx context.Context, job *Job, found func(path string)) error {
+	cars := GatewayCars(job.Cars)
+	if len(cars) == 0 {
+		return errors.New("no payload cid to download from gateway")
+	}
+	gatewayJob := *job
+	gatewayJob.Cars = cars
+	return source.downloadSource.Cars(ctx, &gatewayJob, found)
+}
+
+// GatewayCars returns the cars to download from gateways, one for each payload cid of carInfos,
+// sizes and hashes are not kept since the gateway car is not the same file as the original car
+func GatewayCars(carInfos []*CarInfo) (cars []*CarInfo) {
+	seen := make(map[string]bool)
+	for _, info := range carInfos {
+		if info.CID == "" || seen[info.CID] {
+			continue
+		}
+		seen[info.CID] = true
+		cars = append(cars, &CarInfo{CarFileUrl: ipfsScheme + info.CID, CID: info.CID})
+	}
+	return
+}
+
+func (fetcher *GatewayFetcher) Fetch(ctx context.Context, info *DownloadInfo) (err error) {
+	if len(fetcher.gateways) == 0 {
+		return errors.New("no ipfs gateway configured")
+	}
+	if info.Car == nil || info.Car.CID == "" {
+		return errors.New("gateway download without payload cid")
+	}
+	root, err := cid.Parse(info.Car.CID)
+	if err != nil {
+		return fmt.Errorf("invalid payload cid %s: %w", info.Car.CID, err)
+	}
+	path := info.Path()
+	partPath := path + partSuffix
+	for _, gateway := range fetcher.gateways {
+		info.SetProgress(0, 0)
+		if err = fetcher.fetchFrom(ctx, gateway, root, partPath, info); err == nil {
+			return os.Rename(partPath, path)
+		}
+		os.Remove(partPath)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Warnf("fetch %s from gateway %s failed: %v", root, gateway, err)
+	}
+	return
+}
+
+// fetchFrom streams the car of root from the gateway into partPath, verifying each block and the root
+func (fetcher *GatewayFetcher) fetchFrom(ctx context.Context, gateway string, root cid.Cid, partPath string, info *DownloadInfo) error {
+	fileURL := fmt.Sprintf("%s/ipfs/%s?format=car", gateway, root)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", carContentType)
+	resp, err := fetcher.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newHTTPStatusError(resp, fileURL)
+	}
+
+	body := io.TeeReader(resp.Body, progressWriter(info.AddProgress))
+	reader, err := car.NewCarReader(bufio.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid car from %s: %w", fileURL, err)
+	}
+	if len(reader.Header.Roots) != 1 || !reader.Header.Roots[0].Equals(root) {
+		return fmt.Errorf("car roots %v from %s not matched %s", reader.Header.Roots, fileURL, root)
+	}
+
+	f, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriterSize(f, carWriterBuffer)
+	if err = car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, w); err != nil {
+		return err
+	}
+	blocks := 0
+	for {
+		block, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read car from %s: %w", fileURL, err)
+		}
+		if err = verifyBlock(block.Cid(), block.RawData()); err != nil {
+			return err
+		}
+		if blocks == 0 && !block.Cid().Equals(root) {
+			return fmt.Errorf("first block %s from %s is not root %s", block.Cid(), fileURL, root)
+		}
+		if err = util.LdWrite(w, block.Cid().Bytes(), block.RawData()); err != nil {
+			return err
+		}
+		blocks++
+	}
+	if blocks == 0 {
+		return fmt.Errorf("empty car from %s", fileURL)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// verifyBlock checks data is hashed to c
+func verifyBlock(c cid.Cid, data []byte) error {
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !sum.Equals(c) {
+		return fmt.Errorf("block %s hash mismatch, got %s", c, sum)
+	}
+	return nil
+}
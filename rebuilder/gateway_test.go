@@ -0,0 +1,156 @@
+package rebuilder
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// testGateway is a stand-in trustless gateway serving the cars of its roots at /ipfs/<cid>?format=car
+func testGateway(t *testing.T, cars map[cid.Cid][]byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := cid.Parse(strings.TrimPrefix(r.URL.Path, "/ipfs/"))
+		data, ok := cars[c]
+		if err != nil || !ok || r.URL.Query().Get("format") != "car" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", carContentType)
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testPayload returns the dag of a directory with two files and the root
+func testPayload(t *testing.T) (*memDAG, ipld.Node, map[string][]byte) {
+	dag := newMemDAG()
+	files := map[string][]byte{
+		"a.txt": testData("gateway a ", 3000),
+		"b.txt": testData("gateway b ", 100),
+	}
+	entries := make(map[string]ipld.Node)
+	for name, data := range files {
+		entries[name] = addFile(t, dag, data)
+	}
+	sub := addDir(t, dag, map[string]ipld.Node{"b.txt": entries["b.txt"]})
+	root := addDir(t, dag, map[string]ipld.Node{"a.txt": entries["a.txt"], "sub": sub})
+	return dag, root, map[string][]byte{"a.txt": files["a.txt"], filepath.Join("sub", "b.txt"): files["b.txt"]}
+}
+
+func TestGatewayFetcherFallback(t *testing.T) {
+	dag, root, _ := testPayload(t)
+	good := carData(t, dag, root.Cid(), nil)
+	tampered := carData(t, dag, root.Cid(), func(c cid.Cid, data []byte) []byte {
+		if c.Type() == cid.Raw {
+			data[0] ^= 0xff
+		}
+		return data
+	})
+	down := testGateway(t, nil)
+	bad := testGateway(t, map[cid.Cid][]byte{root.Cid(): tampered})
+	up := testGateway(t, map[cid.Cid][]byte{root.Cid(): good})
+
+	dir := t.TempDir()
+	info := &DownloadInfo{Car: &CarInfo{CID: root.Cid().String()}, FileURL: ipfsScheme + root.Cid().String(), DirPath: dir, FileName: "root.car"}
+	if err := NewGatewayFetcher([]string{down.URL, bad.URL}).Fetch(context.Background(), info); err == nil {
+		t.Fatal("fetched the car with tampered blocks")
+	}
+	if _, err := os.Stat(info.Path() + partSuffix); !os.IsNotExist(err) {
+		t.Fatalf("part file of the failed fetch is kept: %v", err)
+	}
+
+	if err := NewGatewayFetcher([]string{down.URL, bad.URL, up.URL}).Fetch(context.Background(), info); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(info.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, good) {
+		t.Fatal("fetched car not matched the car of the gateway")
+	}
+}
+
+func TestBuildGatewayCars(t *testing.T) {
+	dag, root, files := testPayload(t)
+	srv := testGateway(t, map[cid.Cid][]byte{root.Cid(): carData(t, dag, root.Cid(), nil)})
+
+	dir := t.TempDir()
+	conf := &config.Config{
+		Task: &config.Task{
+			InputPath:  filepath.Join(dir, "input"),
+			OutputPath: filepath.Join(dir, "output"),
+			Fetcher:    "http",
+			Sink:       SinkNone,
+		},
+		Gateway: &config.Gateway{URLs: []string{srv.URL}},
+	}
+	builder, err := NewRebuilder(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Close()
+	cars := GatewayCars([]*CarInfo{{CID: root.Cid().String()}})
+	if _, err = builder.BuildCars(context.Background(), "payload", cars); err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range files {
+		got, err := os.ReadFile(filepath.Join(conf.Task.OutputPath, "payload", rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("rebuilt %s not matched", rel)
+		}
+	}
+}
+
+// TestBuildFromGateway builds the cars of failing urls from the gateway source selected by name
+func TestBuildFromGateway(t *testing.T) {
+	dag, root, files := testPayload(t)
+	srv := testGateway(t, map[cid.Cid][]byte{root.Cid(): carData(t, dag, root.Cid(), nil)})
+	down := testGateway(t, nil)
+
+	dir := t.TempDir()
+	conf := &config.Config{
+		Task: &config.Task{
+			InputPath:  filepath.Join(dir, "input"),
+			OutputPath: filepath.Join(dir, "output"),
+			Fetcher:    "http",
+			Sink:       SinkNone,
+		},
+		Gateway: &config.Gateway{URLs: []string{srv.URL}},
+	}
+	builder, err := NewRebuilder(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Close()
+	cars := []*CarInfo{{CarFileUrl: down.URL + "/payload.car", CID: root.Cid().String()}}
+	if _, err = builder.BuildCars(context.Background(), "payload", cars); err == nil {
+		t.Fatal("built from the failing car url")
+	}
+	if _, err = builder.BuildFrom(context.Background(), SourceGateway, "payload", cars); err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range files {
+		got, err := os.ReadFile(filepath.Join(conf.Task.OutputPath, "payload", rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("rebuilt %s not matched", rel)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package rebuilder
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+)
+
+const (
+	// graphsplit names the payload cid column playload_cid
+	graphColumnPayloadCid = "playload_cid"
+	graphColumnDetail     = "detail"
+)
+
+// GraphNode is a node of the file tree in the detail column of the manifest.csv of graphsplit,
+// the links are in the order of the dag links
+type GraphNode struct {
+	Name string
+	Hash string
+	Size uint64
+	Link []*GraphNode
+}
+
+// GraphManifest is the file tree of each car of graphsplit keyed by payload cid
+type GraphManifest map[string]*GraphNode
+
+// ReadGraphManifest reads the manifest.csv of graphsplit, both the quoted csv and the raw one
+// with the detail json unquoted in the last column are supported
+func ReadGraphManifest(path string) (GraphManifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		records = nil
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		columns := len(strings.Split(strings.TrimSpace(lines[0]), ","))
+		for _, line := range lines {
+			records = append(records, strings.SplitN(strings.TrimSpace(line), ",", columns))
+		}
+	}
+	if len(records) == 0 {
+		return nil, errors.New("empty graph manifest")
+	}
+	cidCol, detailCol := -1, -1
+	for i, column := range records[0] {
+		switch column {
+		case graphColumnPayloadCid:
+			cidCol = i
+		case graphColumnDetail:
+			detailCol = i
+		}
+	}
+	if cidCol < 0 || detailCol < 0 {
+		return nil, fmt.Errorf("not found column %s or %s", graphColumnPayloadCid, graphColumnDetail)
+	}
+	manifest := make(GraphManifest)
+	for row, fields := range records[1:] {
+		if len(fields) <= cidCol || len(fields) <= detailCol {
+			return nil, fmt.Errorf("invalid graph manifest row %d", row+1)
+		}
+		node := new(GraphNode)
+		if err = json.Unmarshal([]byte(fields[detailCol]), node); err != nil {
+			return nil, fmt.Errorf("invalid detail of row %d: %w", row+1, err)
+		}
+		manifest[fields[cidCol]] = node
+	}
+	return manifest, nil
+}
+
+// selectCars returns the cars holding dataPath or its chunks, cars not in the manifest are kept as unknown
+func (m GraphManifest) selectCars(carInfos []*CarInfo, dataPath string) ([]*CarInfo, error) {
+	var cars []*CarInfo
+	for _, car := range carInfos {
+		if node, ok := m[car.CID]; ok && len(node.selectors(dataPath)) == 0 {
+			log.Infof("skip car %s without %s", car.CID, dataPath)
+			continue
+		}
+		cars = append(cars, car)
+	}
+	if len(cars) == 0 {
+		return nil, fmt.Errorf("%s not found in graph manifest", dataPath)
+	}
+	log.Infof("%d of %d cars hold %s", len(cars), len(carInfos), dataPath)
+	return cars, nil
+}
+
+// selectors returns the datamodel path selectors like Links/2/Hash/Links/0/Hash of the entries
+// at dataPath or its graphsplit chunks under the node
+func (node *GraphNode) selectors(dataPath string) (selectors []string) {
+	dir, name := path.Split(dataPath)
+	var prefix []string
+	for _, dirName := range strings.Split(strings.TrimSuffix(dir, "/"), "/") {
+		if dirName == "" {
+			continue
+		}
+		found := false
+		for i, link := range node.Link {
+			if link.Name == dirName {
+				prefix = append(prefix, "Links", strconv.Itoa(i), "Hash")
+				node, found = link, true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	for i, link := range node.Link {
+		if merged, _, ok := chunkOf(link.Name); link.Name == name || ok && merged == name {
+			selectors = append(selectors, strings.Join(append(prefix, "Links", strconv.Itoa(i), "Hash"), "/"))
+		}
+	}
+	return
+}
+
+// cleanDataPath returns the slash separated path relative to the dataset root, empty for the whole dataset
+func cleanDataPath(dataPath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(dataPath)), "/")
+}
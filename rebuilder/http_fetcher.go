@@ -0,0 +1,493 @@
+package rebuilder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+)
+
+const (
+	partSuffix  = ".part"
+	stateSuffix = ".state"
+
+	defaultConnections = 4
+	// files smaller than minSplitSize are downloaded with one connection
+	minSplitSize      = 16 << 20
+	stateSaveInterval = 2 * time.Second
+)
+
+// HTTPFetcher downloads files by native http client,
+// data is written to a .part file which is renamed after complete,
+// ranged downloads keep their progress in a .part.state file to resume from
+type HTTPFetcher struct {
+	client      *http.Client
+	connections int
+	options     *config.Download
+}
+
+func NewHTTPFetcher(connections int) *HTTPFetcher {
+	if connections <= 0 {
+		connections = defaultConnections
+	}
+	fetcher := &HTTPFetcher{
+		connections: connections,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = fetcher.proxy
+	fetcher.client = &http.Client{Transport: transport}
+	return fetcher
+}
+
+// WithOptions sets the download options, headers, user agent, proxy, split and limit are applied
+func (fetcher *HTTPFetcher) WithOptions(options *config.Download) *HTTPFetcher {
+	fetcher.options = options
+	return fetcher
+}
+
+func (fetcher *HTTPFetcher) proxy(req *http.Request) (*url.URL, error) {
+	if opts := resolveDownloadOptions(fetcher.options, req.URL.String()); opts.AllProxy != "" {
+		return url.Parse(opts.AllProxy)
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// newRequest creates a GET request with the headers and user agent in the options of fileURL
+func (fetcher *HTTPFetcher) newRequest(ctx context.Context, fileURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	opts := resolveDownloadOptions(fetcher.options, fileURL)
+	for _, header := range opts.Headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header: %s", header)
+		}
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if opts.UserAgent != "" {
+		req.Header.Set("User-Agent", opts.UserAgent)
+	}
+	return req, nil
+}
+
+// head sends a HEAD request to fileURL with the headers, user agent and proxy in the options of fileURL
+// in probeTimeout, the response body is closed
+func (fetcher *HTTPFetcher) head(ctx context.Context, fileURL string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	req, err := fetcher.newRequest(ctx, fileURL)
+	if err != nil {
+		return nil, err
+	}
+	req.Method = http.MethodHead
+	resp, err := fetcher.client.Do(req)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+type httpJob struct {
+	info        *DownloadInfo
+	limiter     *rateLimiter
+	connections int
+}
+
+// HTTPStatusError is returned when the server responds an unexpected status code
+type HTTPStatusError struct {
+	URL    string
+	Code   int
+	Status string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("http status: %s, code:%d, url:%s", e.Status, e.Code, e.URL)
+}
+
+// Temporary reports whether the request is worth retrying
+func (e *HTTPStatusError) Temporary() bool {
+	return e.Code >= http.StatusInternalServerError || e.Code == http.StatusTooManyRequests || e.Code == http.StatusRequestTimeout
+}
+
+func newHTTPStatusError(resp *http.Response, fileURL string) error {
+	return &HTTPStatusError{URL: redactURL(fileURL), Code: resp.StatusCode, Status: resp.Status}
+}
+
+// redactURL strips the query of a presigned s3 url, which holds the signature and the session token
+func redactURL(fileURL string) string {
+	u, err := url.Parse(fileURL)
+	if err != nil || u.Query().Get("X-Amz-Signature") == "" {
+		return fileURL
+	}
+	u.RawQuery = ""
+	return u.String()
+}
+
+// redactError strips the query of the presigned s3 url in the url.Error of err
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactURL(urlErr.URL)
+	}
+	return err
+}
+
+type segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"` // inclusive
+	Done  int64 `json:"done"`
+}
+
+func (seg *segment) remain() int64 {
+	return seg.End - seg.Start + 1 - seg.Done
+}
+
+type fetchState struct {
+	URL      string     `json:"url"`
+	Size     int64      `json:"size"`
+	Segments []*segment `json:"segments"`
+}
+
+// Fetch downloads from the mirrors of each group of the same options in turn until one succeeds,
+// a ranged download interrupted is resumed by the next group
+func (fetcher *HTTPFetcher) Fetch(ctx context.Context, info *DownloadInfo) (err error) {
+	groups := groupMirrors(fetcher.options, info.URLs())
+	for i, group := range groups {
+		if err = fetcher.fetch(ctx, info, group); err == nil || ctx.Err() != nil {
+			return
+		}
+		if i < len(groups)-1 {
+			log.Warnf("download %s failed: %v, try the next mirrors", redactURL(group.urls[0]), err)
+		}
+	}
+	return
+}
+
+// fetch downloads from the mirrors of group which are available, ranged segments are spread over them
+// and each segment fails over to the next mirror
+func (fetcher *HTTPFetcher) fetch(ctx context.Context, info *DownloadInfo, group *mirrorGroup) (err error) {
+	path := info.Path()
+	partPath := path + partSuffix
+	var urls []string
+	var size int64
+	ranged := true
+	for _, fileURL := range group.urls {
+		n, r, e := fetcher.probe(ctx, fileURL)
+		if e != nil {
+			log.Warnf("probe %s failed: %v", redactURL(fileURL), e)
+			err = e
+			continue
+		}
+		if len(urls) > 0 && n != size {
+			log.Warnf("mirror %s size %d not matched %d, skip it", redactURL(fileURL), n, size)
+			continue
+		}
+		urls = append(urls, fileURL)
+		size, ranged = n, ranged && r
+	}
+	if len(urls) == 0 {
+		return
+	}
+	opts := group.opts
+	limit, err := parseByteSize(opts.MaxDownloadLimit)
+	if err != nil {
+		return err
+	}
+	job := &httpJob{info: info, limiter: newRateLimiter(limit), connections: fetcher.connections}
+	if opts.Split > 0 {
+		job.connections = opts.Split
+	}
+	if ranged && size > 0 {
+		err = fetcher.fetchRanges(ctx, job, urls, partPath, size)
+	} else {
+		err = fetcher.fetchAll(ctx, job, urls, partPath)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(partPath, path)
+}
+
+// probe returns the file size and whether the server supports range requests
+func (fetcher *HTTPFetcher) probe(ctx context.Context, fileURL string) (size int64, ranged bool, err error) {
+	req, err := fetcher.newRequest(ctx, fileURL)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := fetcher.client.Do(req)
+	if err != nil {
+		return 0, false, redactError(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		contentRange := resp.Header.Get("Content-Range")
+		index := strings.LastIndex(contentRange, "/")
+		if index == -1 {
+			return 0, false, fmt.Errorf("invalid content range: %s", contentRange)
+		}
+		size, err = strconv.ParseInt(contentRange[index+1:], 10, 64)
+		if err != nil {
+			// unknown size like "bytes 0-0/*"
+			return 0, true, nil
+		}
+		return size, true, nil
+	case http.StatusOK:
+		return resp.ContentLength, false, nil
+	}
+	return 0, false, newHTTPStatusError(resp, fileURL)
+}
+
+func (fetcher *HTTPFetcher) fetchAll(ctx context.Context, job *httpJob, urls []string, partPath string) (err error) {
+	for _, fileURL := range urls {
+		if err = fetcher.fetchAllFrom(ctx, job, fileURL, partPath); err == nil || ctx.Err() != nil {
+			return
+		}
+		log.Warnf("download %s failed: %v", redactURL(fileURL), err)
+	}
+	return
+}
+
+func (fetcher *HTTPFetcher) fetchAllFrom(ctx context.Context, job *httpJob, fileURL, partPath string) error {
+	req, err := fetcher.newRequest(ctx, fileURL)
+	if err != nil {
+		return err
+	}
+	resp, err := fetcher.client.Do(req)
+	if err != nil {
+		return redactError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newHTTPStatusError(resp, fileURL)
+	}
+	f, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	job.info.SetProgress(0, resp.ContentLength)
+	body := &limitedReader{ctx: ctx, r: resp.Body, limiter: job.limiter}
+	n, err := io.Copy(f, io.TeeReader(body, progressWriter(job.info.AddProgress)))
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength > 0 && n != resp.ContentLength {
+		return fmt.Errorf("incomplete download %s, expected %d bytes, got %d", redactURL(fileURL), resp.ContentLength, n)
+	}
+	job.info.SetProgress(n, n)
+	return nil
+}
+
+func (fetcher *HTTPFetcher) fetchRanges(ctx context.Context, job *httpJob, urls []string, partPath string, size int64) (err error) {
+	statePath := partPath + stateSuffix
+	state := fetcher.loadState(statePath, job.info.FileURL, size)
+	if state == nil {
+		state = fetcher.newState(job.info.FileURL, size, job.connections)
+		os.Remove(partPath)
+	} else {
+		log.Info("resume download from ", partPath)
+	}
+	f, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		return
+	}
+	var resumed int64
+	for _, seg := range state.Segments {
+		resumed += seg.Done
+	}
+	job.info.SetProgress(resumed, size)
+
+	var mu sync.Mutex
+	save := func() {
+		mu.Lock()
+		b, _ := json.Marshal(state)
+		mu.Unlock()
+		if e := os.WriteFile(statePath, b, 0666); e != nil {
+			log.Warn("save download state failed: ", e)
+		}
+	}
+	done, saved := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(saved)
+		ticker := time.NewTicker(stateSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				save()
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var once sync.Once
+	var wg sync.WaitGroup
+	for i, seg := range state.Segments {
+		if seg.remain() <= 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, seg *segment) {
+			defer wg.Done()
+			if e := fetcher.fetchRange(ctx, job, urls, i, f, seg, &mu); e != nil {
+				once.Do(func() {
+					err = e
+					cancel()
+				})
+			}
+		}(i, seg)
+	}
+	wg.Wait()
+	close(done)
+	<-saved
+	if err != nil {
+		save()
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	os.Remove(statePath)
+	return nil
+}
+
+// fetchRange downloads seg starting from urls[index], and tries the next url on failure
+func (fetcher *HTTPFetcher) fetchRange(ctx context.Context, job *httpJob, urls []string, index int, f *os.File, seg *segment, mu *sync.Mutex) (err error) {
+	for i := 0; i < len(urls); i++ {
+		fileURL := urls[(index+i)%len(urls)]
+		if err = fetcher.fetchRangeFrom(ctx, job, fileURL, f, seg, mu); err == nil || ctx.Err() != nil {
+			return
+		}
+		log.Warnf("download range %d-%d from %s failed: %v", seg.Start, seg.End, redactURL(fileURL), err)
+	}
+	return
+}
+
+func (fetcher *HTTPFetcher) fetchRangeFrom(ctx context.Context, job *httpJob, fileURL string, f *os.File, seg *segment, mu *sync.Mutex) error {
+	mu.Lock()
+	offset := seg.Start + seg.Done
+	mu.Unlock()
+	req, err := fetcher.newRequest(ctx, fileURL)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, seg.End))
+	resp, err := fetcher.client.Do(req)
+	if err != nil {
+		return redactError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return newHTTPStatusError(resp, fileURL)
+	}
+
+	buf := make([]byte, 256<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if e := job.limiter.wait(ctx, n); e != nil {
+				return e
+			}
+			if _, e := f.WriteAt(buf[:n], offset); e != nil {
+				return e
+			}
+			offset += int64(n)
+			mu.Lock()
+			seg.Done += int64(n)
+			mu.Unlock()
+			job.info.AddProgress(int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if offset != seg.End+1 {
+		return fmt.Errorf("incomplete range %d-%d, got to %d, url:%s", seg.Start, seg.End, offset, redactURL(fileURL))
+	}
+	return nil
+}
+
+func (fetcher *HTTPFetcher) newState(fileURL string, size int64, connections int) *fetchState {
+	num := int64(connections)
+	if size < minSplitSize {
+		num = 1
+	}
+	state := &fetchState{URL: fileURL, Size: size}
+	step := size / num
+	for i := int64(0); i < num; i++ {
+		seg := &segment{Start: i * step, End: (i+1)*step - 1}
+		if i == num-1 {
+			seg.End = size - 1
+		}
+		state.Segments = append(state.Segments, seg)
+	}
+	return state
+}
+
+// loadState returns nil if no state saved or the state not matched
+func (fetcher *HTTPFetcher) loadState(statePath, fileURL string, size int64) *fetchState {
+	b, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil
+	}
+	var state fetchState
+	if err = json.Unmarshal(b, &state); err != nil {
+		return nil
+	}
+	if state.URL != fileURL || state.Size != size || len(state.Segments) == 0 {
+		return nil
+	}
+	if _, err = os.Stat(strings.TrimSuffix(statePath, stateSuffix)); err != nil {
+		return nil
+	}
+	return &state
+}
+
+type progressWriter func(n int64)
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	w(int64(len(p)))
+	return len(p), nil
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if e := l.limiter.wait(l.ctx, n); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
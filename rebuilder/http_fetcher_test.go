@@ -0,0 +1,96 @@
+package rebuilder
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/s3"
+)
+
+// TestFetchPresignedRedacted fetches s3 urls presigned with a session token from a stand-in s3
+// failing the requests, the errors must not hold the signature or the token
+func TestFetchPresignedRedacted(t *testing.T) {
+	const token = "secret-session-token"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	client, err := s3.NewClient(&s3.Config{Endpoint: srv.URL, AccessKey: "access", SecretKey: "secret", SessionToken: token, PathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	closedClient, err := s3.NewClient(&s3.Config{Endpoint: closed.URL, AccessKey: "access", SecretKey: "secret", SessionToken: token, PathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*s3.Client{client, closedClient} {
+		downloader := NewDownloader(1, NewHTTPFetcher(1)).WithS3(c)
+		info := &DownloadInfo{FileURL: "s3://bucket/a.car", DirPath: t.TempDir(), FileName: "a.car"}
+		if err = downloader.resolve(info); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = downloader.fetcher.Fetch(ctx, info)
+		cancel()
+		if err == nil {
+			t.Fatal("fetched from the failing s3")
+		}
+		if msg := err.Error(); strings.Contains(msg, "X-Amz-Signature") || strings.Contains(msg, token) {
+			t.Fatalf("presigned url in error: %s", msg)
+		}
+	}
+}
+
+// TestFetchMirrorHosts fetches a car from the mirrors of two hosts, the first with a token header
+// failing the requests, the token must never be sent to the other host
+func TestFetchMirrorHosts(t *testing.T) {
+	data := testData("mirror ", 1000)
+	var mu sync.Mutex
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Host+" "+r.Header.Get("X-Token"))
+		mu.Unlock()
+		if strings.HasPrefix(r.Host, "127.0.0.1") {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "a.car", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+	mirror := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	conf := &config.Download{Hosts: []*config.DownloadHost{{
+		Host:            "127.0.0.1",
+		DownloadOptions: config.DownloadOptions{Headers: []string{"X-Token: secret"}, Split: 2},
+	}}}
+
+	fetcher := NewHTTPFetcher(1).WithOptions(conf)
+	info := &DownloadInfo{FileURL: srv.URL + "/a.car", Mirrors: []string{mirror + "/a.car"}, DirPath: t.TempDir(), FileName: "a.car"}
+	if err := fetcher.Fetch(context.Background(), info); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(info.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("fetched car not matched")
+	}
+	for _, token := range tokens {
+		host, value, _ := strings.Cut(token, " ")
+		if strings.HasPrefix(host, "127.0.0.1") != (value == "secret") {
+			t.Fatalf("token %q sent to %s", value, host)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package rebuilder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+)
+
+const (
+	fileScheme = "file://"
+
+	LocalModeHardlink = "hardlink" // hard link, copy if on different filesystems
+	LocalModeSymlink  = "symlink"
+	LocalModeCopy     = "copy"
+)
+
+// FileURL returns the file:// url of path
+func FileURL(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String(), nil
+}
+
+// localPath returns the path of a file:// url, ok is false if not a file url
+func localPath(fileURL string) (path string, ok bool, err error) {
+	if !strings.HasPrefix(fileURL, fileScheme) {
+		return
+	}
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return "", true, err
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", true, fmt.Errorf("not local file url: %s", fileURL)
+	}
+	return filepath.FromSlash(u.Path), true, nil
+}
+
+// LocalCars returns the cars of the .car files in dir and its sub directories, in the order of paths
+func LocalCars(dir string) (carInfos []*CarInfo, err error) {
+	paths, err := carFiles(dir)
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		fileURL, err := FileURL(path)
+		if err != nil {
+			return nil, err
+		}
+		carInfos = append(carInfos, &CarInfo{CarFileUrl: fileURL})
+	}
+	return
+}
+
+// carFiles returns the sorted paths of the .car files in dir and its sub directories
+func carFiles(dir string) (paths []string, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(path), carExt) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no car file in %s", dir)
+	}
+	sort.Strings(paths)
+	return
+}
+
+// fetchLocal places the first available local file of info at its path by the local mode
+func (downloader *Downloader) fetchLocal(ctx context.Context, info *DownloadInfo) (err error) {
+	for _, src := range info.local {
+		if err = downloader.place(ctx, info, src); err == nil {
+			return
+		}
+		log.Warnf("use local car %s failed: %v", src, err)
+	}
+	return
+}
+
+// place links or copies src to the path of info, the file is staged in a .part file which is renamed over
+// the path, so an existing file at the path is only replaced once the new one is ready
+func (downloader *Downloader) place(ctx context.Context, info *DownloadInfo, src string) error {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file: %s", src)
+	}
+	path := info.Path()
+	if dst, err := os.Stat(path); err == nil && os.SameFile(stat, dst) {
+		// src is already at the path, like a car in the car dir
+		info.SetProgress(stat.Size(), stat.Size())
+		return nil
+	}
+	switch downloader.localMode {
+	case LocalModeSymlink:
+		abs, err := filepath.Abs(src)
+		if err != nil {
+			return err
+		}
+		if err = linkFile(os.Symlink, abs, path); err == nil {
+			info.SetProgress(stat.Size(), stat.Size())
+		}
+		return err
+	case "", LocalModeHardlink:
+		if err = linkFile(os.Link, src, path); err == nil {
+			info.SetProgress(stat.Size(), stat.Size())
+			return nil
+		}
+		log.Debugf("hard link %s failed: %v, copy it", src, err)
+	case LocalModeCopy:
+	default:
+		return fmt.Errorf("not supported local mode: %s", downloader.localMode)
+	}
+	info.SetProgress(0, stat.Size())
+	return copyFile(ctx, src, path, progressWriter(info.AddProgress))
+}
+
+// linkFile links src to a .part file by link, which is renamed to dst
+func linkFile(link func(oldname, newname string) error, src, dst string) error {
+	partPath := dst + partSuffix
+	if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := link(src, partPath); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, dst); err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	return nil
+}
+
+// copyFile copies src to a .part file which is renamed to dst after complete
+func copyFile(ctx context.Context, src, dst string, progress io.Writer) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	partPath := dst + partSuffix
+	out, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.MultiWriter(out, progress), &contextReader{ctx: ctx, r: in})
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	return os.Rename(partPath, dst)
+}
+
+// contextReader stops reading once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// newLocalSource returns the source placing the file:// cars in job.CarDir by the local mode of conf,
+// the cars of other urls are not downloaded
+func newLocalSource(conf *config.Config) (Source, error) {
+	return newDownloadSource(conf, localFetcher{})
+}
+
+// localFetcher fails the urls left after the local files, which is not retryable
+type localFetcher struct{}
+
+func (localFetcher) Fetch(_ context.Context, info *DownloadInfo) error {
+	return &notLocalError{redactURL(info.FileURL)}
+}
+
+// notLocalError is returned for cars without an available file:// url by the local source
+type notLocalError struct {
+	URL string
+}
+
+func (e *notLocalError) Error() string {
+	return "not local car: " + e.URL
+}
+
+// carDirSource is the car files already in job.CarDir
+type carDirSource struct{}
+
+func (carDirSource) Cars(ctx context.Context, job *Job, found func(path string)) error {
+	paths, err := carFiles(job.CarDir)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		found(path)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package rebuilder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPlaceLocal places a local car at its path by each local mode, a car already at the path must be kept
+// and an existing file at the path is replaced
+func TestPlaceLocal(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		same bool // src is the path itself
+	}{
+		{"hardlink", LocalModeHardlink, false},
+		{"symlink", LocalModeSymlink, false},
+		{"copy", LocalModeCopy, false},
+		{"hardlink same", LocalModeHardlink, true},
+		{"symlink same", LocalModeSymlink, true},
+		{"copy same", LocalModeCopy, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			data := testData("local ", 100)
+			info := &DownloadInfo{DirPath: filepath.Join(dir, "cars"), FileName: "a.car"}
+			if err := os.MkdirAll(info.DirPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			src := info.Path()
+			if !tt.same {
+				src = filepath.Join(dir, "a.car")
+				if err := os.WriteFile(info.Path(), []byte("stale"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(src, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			downloader := NewDownloader(1, nil).WithLocalMode(tt.mode)
+			if err := downloader.place(context.Background(), info, src); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(info.Path())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(data) {
+				t.Fatalf("placed car %q, want %q", got, data)
+			}
+			if _, err = os.Lstat(info.Path() + partSuffix); !os.IsNotExist(err) {
+				t.Fatalf("part file left: %v", err)
+			}
+		})
+	}
+}
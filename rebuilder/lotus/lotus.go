@@ -23,6 +23,11 @@ import (
 	"github.com/ipfs/go-cid"
 )
 
+const (
+	retrieveTimeout = 10 * time.Minute
+	cancelTimeout   = 30 * time.Second
+)
+
 type Client struct {
 	node   api.FullNode
 	closer jsonrpc.ClientCloser
@@ -100,7 +105,6 @@ func getMiner(page int) (miners []string, err error) {
 }
 
 func (lotus *Client) GetMinerInfoByFId(minerId string) (string, error) {
-	defer lotus.closer()
 	addr, _ := address.NewFromString(minerId)
 	minerInfo, err := lotus.node.StateMinerInfo(context.TODO(), addr, types.EmptyTSK)
 	if err != nil {
@@ -114,12 +118,10 @@ func (lotus *Client) GetMinerInfoByFId(minerId string) (string, error) {
 }
 
 func (lotus *Client) ListMiners() ([]address.Address, error) {
-	defer lotus.closer()
 	return lotus.node.StateListMiners(context.TODO(), types.EmptyTSK)
 }
 
 func (lotus *Client) getDealsCounts() (map[address.Address]int, error) {
-	defer lotus.closer()
 	allDeals, err := lotus.node.StateMarketDeals(context.TODO(), types.EmptyTSK)
 	if err != nil {
 		return nil, err
@@ -133,10 +135,18 @@ func (lotus *Client) getDealsCounts() (map[address.Address]int, error) {
 	return out, nil
 }
 
-func (lotus *Client) RetrieveData(minerId, dataCid, savePath, wallet string) error {
-	defer lotus.closer()
-	log.Infof("start retrieve-data from minerId: %s,datacid: %s,savepath:%s", minerId, dataCid, savePath)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+// RetrieveData retrieves dataCid from minerId and exports car to savePath,
+// progress is called with the received and total bytes on each retrieval event,
+// the retrieval deal is canceled if ctx is done before it completes
+func (lotus *Client) RetrieveData(ctx context.Context, minerId, dataCid, savePath, wallet string, progress ...func(received, total uint64)) error {
+	return lotus.RetrievePath(ctx, minerId, dataCid, "", savePath, wallet, progress...)
+}
+
+// RetrievePath retrieves the subtree of dataCid matched by the datamodel path selector like Links/2/Hash from minerId
+// and exports car to savePath with the blocks on the path from dataCid, the whole dag is retrieved if selector is empty
+func (lotus *Client) RetrievePath(ctx context.Context, minerId, dataCid, selector, savePath, wallet string, progress ...func(received, total uint64)) error {
+	log.Infof("start retrieve-data from minerId: %s,datacid: %s,selector: %s,savepath:%s", minerId, dataCid, selector, savePath)
+	ctx, cancel := context.WithTimeout(ctx, retrieveTimeout)
 	defer cancel()
 
 	addr, err := address.NewFromString(minerId)
@@ -150,12 +160,16 @@ func (lotus *Client) RetrieveData(minerId, dataCid, savePath, wallet string) err
 		log.Errorf("parse cid failed , dataCid: %s,error: %v", dataCid, err)
 		return err
 	}
-	offer, err := lotus.node.ClientMinerQueryOffer(context.TODO(), addr, root, nil)
+	offer, err := lotus.node.ClientMinerQueryOffer(ctx, addr, root, nil)
 	if err != nil {
 		return err
 	}
 
 	var sel *api.Selector
+	if selector != "" {
+		s := api.Selector(selector)
+		sel = &s
+	}
 	// wallet address
 	pay, err := address.NewFromString(wallet)
 	if err != nil {
@@ -164,12 +178,12 @@ func (lotus *Client) RetrieveData(minerId, dataCid, savePath, wallet string) err
 	o := offer.Order(pay)
 	o.DataSelector = sel
 
-	subscribeEvents, err := lotus.node.ClientGetRetrievalUpdates(context.TODO())
+	subscribeEvents, err := lotus.node.ClientGetRetrievalUpdates(ctx)
 	if err != nil {
 		return fmt.Errorf("error setting up retrieval updates: %w", err)
 	}
 
-	retrievalRes, err := lotus.node.ClientRetrieve(context.TODO(), o)
+	retrievalRes, err := lotus.node.ClientRetrieve(ctx, o)
 	if err != nil {
 		return fmt.Errorf("error setting up retrieval: %w", err)
 	}
@@ -180,7 +194,11 @@ readEvents:
 		var evt api.RetrievalInfo
 		select {
 		case <-ctx.Done():
-			return errors.New("retrieval timeout")
+			lotus.cancelRetrieval(retrievalRes.DealID)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return errors.New("retrieval timeout")
+			}
+			return ctx.Err()
 		case evt = <-subscribeEvents:
 			if evt.ID != retrievalRes.DealID {
 				continue
@@ -192,13 +210,16 @@ readEvents:
 			event = retrievalmarket.ClientEvents[*evt.Event]
 		}
 
-		log.Infof("Recv %s, Paid %s, %s (%s), %s\n",
+		log.Debugf("Recv %s, Paid %s, %s (%s), %s\n",
 			types.SizeStr(types.NewInt(evt.BytesReceived)),
 			types.FIL(evt.TotalPaid),
 			strings.TrimPrefix(event, "ClientEvent"),
 			strings.TrimPrefix(retrievalmarket.DealStatuses[evt.Status], "DealStatus"),
 			time.Since(start).Truncate(time.Millisecond),
 		)
+		for _, fn := range progress {
+			fn(evt.BytesReceived, offer.Size)
+		}
 
 		switch evt.Status {
 		case retrievalmarket.DealStatusCompleted:
@@ -212,17 +233,31 @@ readEvents:
 		}
 	}
 
-	return lotus.node.ClientExport(ctx, api.ExportRef{
+	ref := api.ExportRef{
 		Root:   root,
 		DealID: retrievalRes.DealID,
-	}, api.FileRef{
+	}
+	if sel != nil {
+		ref.DAGs = []api.DagSpec{{DataSelector: sel, ExportMerkleProof: true}}
+	}
+	return lotus.node.ClientExport(ctx, ref, api.FileRef{
 		Path:  savePath,
 		IsCAR: true,
 	})
 }
 
+// cancelRetrieval cancels the retrieval deal with a new context since the retrieval one is done
+func (lotus *Client) cancelRetrieval(dealID retrievalmarket.DealID) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	if err := lotus.node.ClientCancelRetrievalDeal(ctx, dealID); err != nil {
+		log.Warnf("cancel retrieval deal %d failed: %v", dealID, err)
+		return
+	}
+	log.Infof("retrieval deal %d canceled", dealID)
+}
+
 func (lotus *Client) GetCurrentHeight() (int64, error) {
-	defer lotus.closer()
 	tipSet, err := lotus.node.ChainHead(context.TODO())
 	if err != nil {
 		log.Errorf("get ChainHead failed,error: %v", err)
@@ -231,7 +266,12 @@ func (lotus *Client) GetCurrentHeight() (int64, error) {
 	return int64(tipSet.Height()), nil
 }
 
-func (lotus *Client) Close() {
+// Close closes the rpc connection to the lotus node, the client is not usable after it
+func (lotus *Client) Close() error {
+	if lotus.closer != nil {
+		lotus.closer()
+	}
+	return nil
 }
 
 func ArchiveDir(src, out string) error {
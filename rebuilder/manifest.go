@@ -0,0 +1,81 @@
+package rebuilder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+var manifestColumns = []string{"path", "size", "sha256", "payload_cid", "url"}
+
+// ManifestFile is an uploaded file of the rebuilt dataset
+type ManifestFile struct {
+	Path       string `json:"path"` // relative to the output directory, slash separated
+	Size       int64  `json:"size"`
+	Sha256     string `json:"sha256"`
+	PayloadCid string `json:"payload_cid"` // payload cid of the uploaded file
+	URL        string `json:"url"`         // download url of the mcs gateway
+}
+
+// Manifest lists the uploaded files of a build in the walk order of the output directory
+type Manifest struct {
+	Files []*ManifestFile `json:"files"`
+}
+
+// WriteJSON writes the manifest as indented json
+func (m *Manifest) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// WriteCSV writes the manifest as csv with a header row
+func (m *Manifest) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(manifestColumns); err != nil {
+		return err
+	}
+	for _, file := range m.Files {
+		if err := cw.Write(file.row()); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteTable writes the manifest as an aligned text table
+func (m *Manifest) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(manifestColumns, "\t"))
+	for _, file := range m.Files {
+		fmt.Fprintln(tw, strings.Join(file.row(), "\t"))
+	}
+	return tw.Flush()
+}
+
+func (file *ManifestFile) row() []string {
+	return []string{file.Path, strconv.FormatInt(file.Size, 10), file.Sha256, file.PayloadCid, file.URL}
+}
+
+// fileSha256 returns the hex sha256 of the file at path
+func fileSha256(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sha := sha256.New()
+	if _, err = io.Copy(sha, &contextReader{ctx: ctx, r: f}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sha.Sum(nil)), nil
+}
@@ -2,7 +2,10 @@ package mcs
 
 import (
 	"net/url"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/filswan/go-mcs-sdk/mcs/api/bucket"
 	"github.com/filswan/go-mcs-sdk/mcs/api/common/logs"
@@ -12,6 +15,8 @@ import (
 type BucketClient struct {
 	client     *bucket.BucketClient
 	bucketName string
+	mu         sync.Mutex
+	folders    map[string]bool // folders known to exist in the bucket
 }
 
 func NewBucketClient(key, token, network, bucketName string) (client *BucketClient, err error) {
@@ -31,11 +36,25 @@ func NewBucketClient(key, token, network, bucketName string) (client *BucketClie
 	return &BucketClient{
 		client:     bucketClient,
 		bucketName: bucketName,
+		folders:    make(map[string]bool),
 	}, nil
 }
 
-func (bc *BucketClient) UploadFile(path string, replace bool) (downloadURL string, err error) {
-	name := filepath.Base(path)
+// File is a file uploaded to the bucket
+type File struct {
+	PayloadCid string
+	URL        string // download url of the mcs gateway
+}
+
+// Upload uploads the file at path to the bucket as the object of the slash separated name, the folders of name
+// are created if not exist, and returns its payload cid and download url
+func (bc *BucketClient) Upload(path, name string, replace bool) (file *File, err error) {
+	name = strings.Trim(name, "/")
+	if i := strings.LastIndex(name, "/"); i > 0 {
+		if err = bc.createFolders(name[:i]); err != nil {
+			return
+		}
+	}
 	if err = bc.client.UploadFile(bc.bucketName, name, path, replace); err != nil {
 		return
 	}
@@ -47,5 +66,38 @@ func (bc *BucketClient) UploadFile(path string, replace bool) (downloadURL strin
 	if err != nil {
 		return
 	}
-	return url.JoinPath(*gateway, "ipfs", ossFile.PayloadCid)
+	downloadURL, err := url.JoinPath(*gateway, "ipfs", ossFile.PayloadCid)
+	if err != nil {
+		return
+	}
+	return &File{PayloadCid: ossFile.PayloadCid, URL: downloadURL}, nil
+}
+
+// createFolders creates each folder of the slash separated dir not in the bucket
+func (bc *BucketClient) createFolders(dir string) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	parent := ""
+	for _, name := range strings.Split(dir, "/") {
+		folder := path.Join(parent, name)
+		if !bc.folders[folder] {
+			if _, err := bc.client.GetFile(bc.bucketName, folder); err != nil {
+				if _, err = bc.client.CreateFolder(bc.bucketName, name, parent); err != nil {
+					return err
+				}
+			}
+			bc.folders[folder] = true
+		}
+		parent = folder
+	}
+	return nil
+}
+
+// UploadFile uploads the file at path to the bucket by its base name, and returns its download url
+func (bc *BucketClient) UploadFile(path string, replace bool) (downloadURL string, err error) {
+	file, err := bc.Upload(path, filepath.Base(path), replace)
+	if err != nil {
+		return
+	}
+	return file.URL, nil
 }
@@ -0,0 +1,169 @@
+package rebuilder
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/aria2"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+)
+
+// resolveDownloadOptions returns the options for fileURL, the non-empty options of the matched host
+// override the global ones and its headers are appended, a host starting with "." matches all subdomains
+func resolveDownloadOptions(conf *config.Download, fileURL string) (opts config.DownloadOptions) {
+	if conf == nil {
+		return
+	}
+	opts = conf.DownloadOptions
+	opts.Headers = append([]string(nil), conf.Headers...)
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return
+	}
+	hostname := strings.ToLower(u.Hostname())
+	for _, host := range conf.Hosts {
+		h := strings.ToLower(host.Host)
+		if h != hostname && !(strings.HasPrefix(h, ".") && strings.HasSuffix(hostname, h)) {
+			continue
+		}
+		o := host.DownloadOptions
+		if o.MaxDownloadLimit != "" {
+			opts.MaxDownloadLimit = o.MaxDownloadLimit
+		}
+		if o.Split > 0 {
+			opts.Split = o.Split
+		}
+		if o.MaxConnectionPerServer > 0 {
+			opts.MaxConnectionPerServer = o.MaxConnectionPerServer
+		}
+		if o.UserAgent != "" {
+			opts.UserAgent = o.UserAgent
+		}
+		if o.AllProxy != "" {
+			opts.AllProxy = o.AllProxy
+		}
+		opts.Checksum = opts.Checksum || o.Checksum
+		opts.Continue = opts.Continue || o.Continue
+		opts.Headers = append(opts.Headers, o.Headers...)
+		break
+	}
+	return
+}
+
+// mirrorGroup is the urls of a file sharing the same resolved options
+type mirrorGroup struct {
+	urls []string
+	opts config.DownloadOptions
+}
+
+// groupMirrors groups urls by their resolved options in the order of first appearance, each group is
+// downloaded separately so the options of a host, like its headers, are never sent to another host
+func groupMirrors(conf *config.Download, urls []string) (groups []*mirrorGroup) {
+	for _, fileURL := range urls {
+		opts := resolveDownloadOptions(conf, fileURL)
+		var group *mirrorGroup
+		for _, g := range groups {
+			if reflect.DeepEqual(g.opts, opts) {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			group = &mirrorGroup{opts: opts}
+			groups = append(groups, group)
+		}
+		group.urls = append(group.urls, fileURL)
+	}
+	return
+}
+
+func aria2DownloadOption(opts config.DownloadOptions, car *CarInfo) *aria2.DownloadOption {
+	option := &aria2.DownloadOption{
+		MaxDownloadLimit: opts.MaxDownloadLimit,
+		Header:           opts.Headers,
+		UserAgent:        opts.UserAgent,
+		AllProxy:         opts.AllProxy,
+	}
+	if opts.Split > 0 {
+		option.Split = strconv.Itoa(opts.Split)
+	}
+	if opts.MaxConnectionPerServer > 0 {
+		option.MaxConnectionPerServer = strconv.Itoa(opts.MaxConnectionPerServer)
+	}
+	if opts.Continue {
+		option.Continue = "true"
+	}
+	if opts.Checksum && car != nil && car.CarFileSha256 != "" {
+		option.Checksum = "sha-256=" + strings.ToLower(car.CarFileSha256)
+	}
+	return option
+}
+
+// parseByteSize parses size in aria2 format like 1024, 500K or 10M, K is 1024 and M is 1024K
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	unit := int64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		unit = 1 << 10
+	case 'm', 'M':
+		unit = 1 << 20
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size: %s", s)
+	}
+	return n * unit, nil
+}
+
+// rateLimiter limits the bytes per second shared by all connections of a download
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate}
+}
+
+// wait blocks until n bytes are allowed, nil limiter never blocks
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
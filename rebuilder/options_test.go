@@ -0,0 +1,136 @@
+package rebuilder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+)
+
+func TestResolveDownloadOptions(t *testing.T) {
+	conf := &config.Download{
+		DownloadOptions: config.DownloadOptions{
+			MaxDownloadLimit: "1M",
+			Split:            4,
+			Headers:          []string{"X-Global: 1"},
+			UserAgent:        "rebuilder",
+		},
+		Hosts: []*config.DownloadHost{
+			{Host: "a.example.com", DownloadOptions: config.DownloadOptions{Split: 8, Headers: []string{"X-Token: a"}}},
+			{Host: ".example.com", DownloadOptions: config.DownloadOptions{MaxDownloadLimit: "2M", Checksum: true}},
+			{Host: "B.Example.Org", DownloadOptions: config.DownloadOptions{UserAgent: "b", AllProxy: "http://proxy"}},
+			{Host: ".example.com", DownloadOptions: config.DownloadOptions{Continue: true}},
+		},
+	}
+	global := config.DownloadOptions{MaxDownloadLimit: "1M", Split: 4, Headers: []string{"X-Global: 1"}, UserAgent: "rebuilder"}
+	with := func(fn func(o *config.DownloadOptions)) config.DownloadOptions {
+		o := global
+		o.Headers = append([]string(nil), global.Headers...)
+		fn(&o)
+		return o
+	}
+
+	tests := []struct {
+		name string
+		conf *config.Download
+		url  string
+		want config.DownloadOptions
+	}{
+		{"nil conf", nil, "http://a.example.com/a.car", config.DownloadOptions{}},
+		{"global only", conf, "http://other.net/a.car", global},
+		{"invalid url", conf, "http://a b.example.com\x7f/a.car", global},
+		{"exact host first match", conf, "http://a.example.com/a.car", with(func(o *config.DownloadOptions) {
+			o.Split = 8
+			o.Headers = append(o.Headers, "X-Token: a")
+		})},
+		{"subdomain", conf, "https://c.example.com:8443/a.car", with(func(o *config.DownloadOptions) {
+			o.MaxDownloadLimit = "2M"
+			o.Checksum = true
+		})},
+		{"nested subdomain", conf, "http://x.y.example.com/a.car", with(func(o *config.DownloadOptions) {
+			o.MaxDownloadLimit = "2M"
+			o.Checksum = true
+		})},
+		{"bare domain not subdomain", conf, "http://example.com/a.car", global},
+		{"suffix not subdomain", conf, "http://badexample.com/a.car", global},
+		{"case insensitive", conf, "http://b.EXAMPLE.org/a.car", with(func(o *config.DownloadOptions) {
+			o.UserAgent = "b"
+			o.AllProxy = "http://proxy"
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveDownloadOptions(tt.conf, tt.url); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("options %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// the appended host headers never change the global ones
+	resolveDownloadOptions(conf, "http://a.example.com/a.car")
+	if !reflect.DeepEqual(conf.Headers, []string{"X-Global: 1"}) {
+		t.Fatalf("global headers changed to %v", conf.Headers)
+	}
+}
+
+func TestGroupMirrors(t *testing.T) {
+	conf := &config.Download{Hosts: []*config.DownloadHost{
+		{Host: "a.example.com", DownloadOptions: config.DownloadOptions{Headers: []string{"X-Token: a"}}},
+		{Host: ".mirror.net", DownloadOptions: config.DownloadOptions{Headers: []string{"X-Token: m"}}},
+	}}
+	tests := []struct {
+		name string
+		urls []string
+		want [][]string
+	}{
+		{"one host", []string{"http://a.example.com/1.car", "http://a.example.com/2.car"},
+			[][]string{{"http://a.example.com/1.car", "http://a.example.com/2.car"}}},
+		{"same options grouped", []string{"http://x.mirror.net/a.car", "http://y.mirror.net/a.car"},
+			[][]string{{"http://x.mirror.net/a.car", "http://y.mirror.net/a.car"}}},
+		{"different options split in order", []string{
+			"http://x.mirror.net/a.car", "http://a.example.com/a.car", "http://other.org/a.car", "http://y.mirror.net/a.car",
+		}, [][]string{
+			{"http://x.mirror.net/a.car", "http://y.mirror.net/a.car"},
+			{"http://a.example.com/a.car"},
+			{"http://other.org/a.car"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][]string
+			for _, group := range groupMirrors(conf, tt.urls) {
+				got = append(got, group.urls)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("groups %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"1024", 1024, false},
+		{" 500K ", 500 << 10, false},
+		{"10m", 10 << 20, false},
+		{"1G", 0, true},
+		{"-1K", 0, true},
+		{"K", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseByteSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("size %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,486 @@
+package rebuilder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+	"github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/hamt"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	"github.com/ipfs/go-unixfs/importer/helpers"
+	uio "github.com/ipfs/go-unixfs/io"
+	unixfs_pb "github.com/ipfs/go-unixfs/pb"
+)
+
+const (
+	// defaultChunkSize and defaultMaxLinks are the dag parameters of graphsplit,
+	// used when they can not be told from the original dag
+	defaultChunkSize = 1 << 20
+	defaultMaxLinks  = 1 << 10
+)
+
+// PayloadError is returned when the rebuilt files do not reproduce the payload cid of a root
+type PayloadError struct {
+	Root cid.Cid
+	Got  cid.Cid // undefined if the dag is not rebuilt
+	Err  error
+}
+
+func (e *PayloadError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("verify payload %s failed: %v", e.Root, e.Err)
+	}
+	return fmt.Sprintf("payload cid %s not matched rebuilt %s", e.Root, e.Got)
+}
+
+func (e *PayloadError) Unwrap() error {
+	return e.Err
+}
+
+// payload is a restored dag, the root of a car or a node under it written at rel in the output directory,
+// rel is empty for a root written by restore.Restorer.WriteTo
+type payload struct {
+	cid cid.Cid
+	rel string
+}
+
+// payloadVerifier rebuilds the dag of each root from the restored files with the same chunk size, raw leaves,
+// cid prefix, links per level and directory layout as the original dag, the graphsplit chunks of a file
+// are read from the merged file, padding files of graphsplit are taken from the original dag
+type payloadVerifier struct {
+	dag       ipld.DAGService
+	outputDir string
+	offsets   map[string]int64 // offset of each chunk in the merged file, keyed by the relative path of the chunk
+}
+
+// verifyPayloads verifies the files in outputDir reproduce each payload
+func verifyPayloads(ctx context.Context, dag ipld.DAGService, payloads []payload, outputDir string, parallel int) error {
+	verifier := &payloadVerifier{dag: dag, outputDir: outputDir, offsets: make(map[string]int64)}
+	sizes := make(map[string]map[int]int64)
+	for _, p := range payloads {
+		if err := verifier.chunkSizes(ctx, p.cid, p.rel, sizes); err != nil {
+			return &PayloadError{Root: p.cid, Err: err}
+		}
+	}
+	for merged, chunks := range sizes {
+		indexes := make([]int, 0, len(chunks))
+		for index := range chunks {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		var offset int64
+		for _, index := range indexes {
+			verifier.offsets[fmt.Sprintf(chunkSuffixFormat, merged, index)] = offset
+			offset += chunks[index]
+		}
+	}
+
+	if parallel <= 0 {
+		parallel = 1
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []string
+	limit := make(chan struct{}, parallel)
+	for _, p := range payloads {
+		limit <- struct{}{}
+		wg.Add(1)
+		go func(p payload) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			err := verifier.verify(ctx, p)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err.Error())
+				mu.Unlock()
+				return
+			}
+			log.Info("verified payload :", p.cid)
+		}(p)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d payloads not reproduced: %s", len(errs), len(payloads), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (verifier *payloadVerifier) verify(ctx context.Context, p payload) error {
+	root, rel := p.cid, p.rel
+	if nd, err := verifier.dag.Get(ctx, root); err == nil && rel == "" && !isDir(nd) {
+		// a file root is written as <root cid>
+		rel = root.String()
+	}
+	nd, err := verifier.rebuild(ctx, root, rel)
+	if err != nil {
+		return &PayloadError{Root: root, Err: err}
+	}
+	if !nd.Cid().Equals(root) {
+		return &PayloadError{Root: root, Got: nd.Cid()}
+	}
+	return nil
+}
+
+// chunkSizes records the size of each graphsplit chunk at or under rel of c by the merged path and chunk index
+func (verifier *payloadVerifier) chunkSizes(ctx context.Context, c cid.Cid, rel string, sizes map[string]map[int]int64) error {
+	nd, err := verifier.dag.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	if isDir(nd) {
+		links, err := verifier.entries(ctx, nd)
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			if err = verifier.chunkSizes(ctx, link.Cid, filepath.Join(rel, link.Name), sizes); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	merged, index, ok := chunkOf(rel)
+	if !ok {
+		return nil
+	}
+	size, err := fileSize(nd)
+	if err != nil {
+		return err
+	}
+	if sizes[merged] == nil {
+		sizes[merged] = make(map[int]int64)
+	}
+	sizes[merged][index] = size
+	return nil
+}
+
+// rebuild rebuilds the node of c from the restored file or directory at rel
+func (verifier *payloadVerifier) rebuild(ctx context.Context, c cid.Cid, rel string) (ipld.Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	nd, err := verifier.dag.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if raw, ok := nd.(*merkledag.RawNode); ok {
+		return verifier.rebuildRaw(raw, rel)
+	}
+	pn, ok := nd.(*merkledag.ProtoNode)
+	if !ok {
+		return nil, fmt.Errorf("not supported node %s of codec %d", c, c.Type())
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return nil, fmt.Errorf("node %s is not unixfs: %w", c, err)
+	}
+	switch fsn.Type() {
+	case unixfs_pb.Data_Directory:
+		return verifier.rebuildDir(ctx, pn, rel)
+	case unixfs_pb.Data_HAMTShard:
+		return verifier.rebuildShard(ctx, pn, fsn, rel)
+	case unixfs_pb.Data_File, unixfs_pb.Data_Raw:
+		return verifier.rebuildFile(ctx, pn, fsn, rel)
+	case unixfs_pb.Data_Symlink:
+		target, err := os.Readlink(filepath.Join(verifier.outputDir, rel))
+		if err != nil {
+			return nil, err
+		}
+		if target != string(fsn.Data()) {
+			return nil, fmt.Errorf("symlink %s target %s not matched %s", rel, target, fsn.Data())
+		}
+		return pn, nil
+	default:
+		return nil, fmt.Errorf("not supported unixfs type %s of %s", fsn.Type(), rel)
+	}
+}
+
+// rebuildDir rebuilds the links of the directory with the rebuilt children, the directory removed as
+// graphsplit padding is taken from the original dag
+func (verifier *payloadVerifier) rebuildDir(ctx context.Context, pn *merkledag.ProtoNode, rel string) (ipld.Node, error) {
+	if rel != "" {
+		if _, err := os.Stat(filepath.Join(verifier.outputDir, rel)); os.IsNotExist(err) && verifier.hasPadding(ctx, pn) {
+			return pn, nil
+		}
+	}
+	links := make([]*ipld.Link, 0, len(pn.Links()))
+	for _, link := range pn.Links() {
+		if link.Name == carPaddingFileName {
+			links = append(links, link)
+			continue
+		}
+		child, err := verifier.rebuild(ctx, link.Cid, filepath.Join(rel, link.Name))
+		if err != nil {
+			return nil, err
+		}
+		size, err := child.Size()
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, &ipld.Link{Name: link.Name, Size: size, Cid: child.Cid()})
+	}
+	dir := pn.Copy().(*merkledag.ProtoNode)
+	if err := dir.SetLinks(links); err != nil {
+		return nil, err
+	}
+	return dir, nil
+}
+
+// rebuildShard rebuilds the HAMT sharded directory with the rebuilt children, the shards are built again
+// with the fanout of the original directory, so the same entries reproduce the same shards
+func (verifier *payloadVerifier) rebuildShard(ctx context.Context, pn *merkledag.ProtoNode, fsn *unixfs.FSNode, rel string) (ipld.Node, error) {
+	if fsn.HashType() != hamt.HashMurmur3 {
+		return nil, fmt.Errorf("not supported hash function %d of sharded directory %s", fsn.HashType(), rel)
+	}
+	links, err := verifier.entries(ctx, pn)
+	if err != nil {
+		return nil, err
+	}
+	shard, err := hamt.NewShard(discardDAG{}, int(fsn.Fanout()))
+	if err != nil {
+		return nil, err
+	}
+	shard.SetCidBuilder(pn.Cid().Prefix())
+	for _, link := range links {
+		if link.Name == carPaddingFileName {
+			if err = shard.SetLink(ctx, link.Name, link); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		child, err := verifier.rebuild(ctx, link.Cid, filepath.Join(rel, link.Name))
+		if err != nil {
+			return nil, err
+		}
+		size, err := child.Size()
+		if err != nil {
+			return nil, err
+		}
+		if err = shard.SetLink(ctx, link.Name, &ipld.Link{Size: size, Cid: child.Cid()}); err != nil {
+			return nil, err
+		}
+	}
+	return shard.Node()
+}
+
+// entries returns the links of the entries in the basic or HAMT sharded directory with their names
+func (verifier *payloadVerifier) entries(ctx context.Context, nd ipld.Node) ([]*ipld.Link, error) {
+	dir, err := uio.NewDirectoryFromNode(verifier.dag, nd)
+	if err != nil {
+		return nil, err
+	}
+	return dir.Links(ctx)
+}
+
+// hasPadding returns whether the padding file of graphsplit is in the directory or its sub directories
+func (verifier *payloadVerifier) hasPadding(ctx context.Context, nd ipld.Node) bool {
+	links, err := verifier.entries(ctx, nd)
+	if err != nil {
+		return false
+	}
+	for _, link := range links {
+		if link.Name == carPaddingFileName {
+			return true
+		}
+		if child, err := verifier.dag.Get(ctx, link.Cid); err == nil && isDir(child) && verifier.hasPadding(ctx, child) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebuildFile chunks the restored file at rel with the dag parameters of the original file node
+func (verifier *payloadVerifier) rebuildFile(ctx context.Context, pn *merkledag.ProtoNode, fsn *unixfs.FSNode, rel string) (ipld.Node, error) {
+	r, closer, err := verifier.open(rel, int64(fsn.FileSize()))
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	chunkSize, rawLeaves, maxLinks, err := verifier.fileParams(ctx, pn, fsn)
+	if err != nil {
+		return nil, err
+	}
+	params := helpers.DagBuilderParams{
+		Maxlinks:   maxLinks,
+		RawLeaves:  rawLeaves,
+		CidBuilder: pn.Cid().Prefix(),
+		Dagserv:    discardDAG{},
+	}
+	db, err := params.New(chunker.NewSizeSplitter(&contextReader{ctx: ctx, r: r}, chunkSize))
+	if err != nil {
+		return nil, err
+	}
+	return balanced.Layout(db)
+}
+
+func (verifier *payloadVerifier) rebuildRaw(raw *merkledag.RawNode, rel string) (ipld.Node, error) {
+	r, closer, err := verifier.open(rel, int64(len(raw.RawData())))
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return merkledag.NewRawNodeWPrefix(data, raw.Cid().Prefix())
+}
+
+// open returns the reader of the restored file at rel, or of the chunk in the merged file if rel is a graphsplit chunk
+func (verifier *payloadVerifier) open(rel string, size int64) (io.Reader, io.Closer, error) {
+	path := filepath.Join(verifier.outputDir, rel)
+	var offset int64
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		merged, _, ok := chunkOf(rel)
+		if !ok {
+			return nil, nil, fmt.Errorf("rebuilt file %s not found", rel)
+		}
+		path = filepath.Join(verifier.outputDir, merged)
+		offset = verifier.offsets[rel]
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if offset+size > stat.Size() {
+		f.Close()
+		return nil, nil, fmt.Errorf("rebuilt file %s size %d less than %d", path, stat.Size(), offset+size)
+	}
+	return io.NewSectionReader(f, offset, size), f, nil
+}
+
+// fileParams tells the chunk size, raw leaves and links per level of the original file node,
+// by its first leaf and its first full intermediate node
+func (verifier *payloadVerifier) fileParams(ctx context.Context, pn *merkledag.ProtoNode, fsn *unixfs.FSNode) (chunkSize int64, rawLeaves bool, maxLinks int, err error) {
+	chunkSize, maxLinks = defaultChunkSize, defaultMaxLinks
+	links := pn.Links()
+	if len(links) == 0 {
+		// the data of a single chunk file is in the node
+		if size := int64(len(fsn.Data())); size > chunkSize {
+			chunkSize = size
+		}
+		return
+	}
+	if len(links) > maxLinks {
+		maxLinks = len(links)
+	}
+	nd, err := verifier.dag.Get(ctx, links[0].Cid)
+	if err != nil {
+		return
+	}
+	if len(nd.Links()) > 0 {
+		// the first child of a balanced dag is full
+		maxLinks = len(nd.Links())
+	}
+	for len(nd.Links()) > 0 {
+		if nd, err = verifier.dag.Get(ctx, nd.Links()[0].Cid); err != nil {
+			return
+		}
+	}
+	switch leaf := nd.(type) {
+	case *merkledag.RawNode:
+		return int64(len(leaf.RawData())), true, maxLinks, nil
+	case *merkledag.ProtoNode:
+		leafFsn, err := unixfs.FSNodeFromBytes(leaf.Data())
+		if err != nil {
+			return 0, false, 0, err
+		}
+		return int64(len(leafFsn.Data())), false, maxLinks, nil
+	default:
+		return 0, false, 0, fmt.Errorf("not supported leaf %s", nd.Cid())
+	}
+}
+
+func isDir(nd ipld.Node) bool {
+	pn, ok := nd.(*merkledag.ProtoNode)
+	if !ok {
+		return false
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	return err == nil && (fsn.Type() == unixfs_pb.Data_Directory || fsn.Type() == unixfs_pb.Data_HAMTShard)
+}
+
+func fileSize(nd ipld.Node) (int64, error) {
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		return int64(len(nd.RawData())), nil
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return 0, err
+		}
+		return int64(fsn.FileSize()), nil
+	default:
+		return 0, fmt.Errorf("not supported node %s", nd.Cid())
+	}
+}
+
+// chunkOf returns the merged path and index of the graphsplit chunk path like name.00000001
+func chunkOf(path string) (merged string, index int, ok bool) {
+	i := strings.LastIndex(path, ".")
+	if i < 0 || !isChunkIndex(path[i+1:]) {
+		return
+	}
+	index, err := strconv.Atoi(path[i+1:])
+	if err != nil {
+		return
+	}
+	return path[:i], index, true
+}
+
+var errDiscardDAG = errors.New("discard dag has no node")
+
+// discardDAG drops the nodes added while rebuilding a dag, only the root cid is needed
+type discardDAG struct{}
+
+func (discardDAG) Get(_ context.Context, c cid.Cid) (ipld.Node, error) {
+	return nil, ipld.ErrNotFound{Cid: c}
+}
+
+func (discardDAG) GetMany(_ context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	for _, c := range cids {
+		out <- &ipld.NodeOption{Err: ipld.ErrNotFound{Cid: c}}
+	}
+	close(out)
+	return out
+}
+
+func (discardDAG) Add(context.Context, ipld.Node) error {
+	return nil
+}
+
+func (discardDAG) AddMany(context.Context, []ipld.Node) error {
+	return nil
+}
+
+func (discardDAG) Remove(context.Context, cid.Cid) error {
+	return errDiscardDAG
+}
+
+func (discardDAG) RemoveMany(context.Context, []cid.Cid) error {
+	return errDiscardDAG
+}
@@ -0,0 +1,130 @@
+package rebuilder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-unixfs/hamt"
+)
+
+// writeFiles writes the files keyed by their paths relative to dir
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for rel, data := range files {
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// shardedPayload returns the dag of a HAMT sharded directory with enough files for sub shards and a sub directory
+func shardedPayload(t *testing.T) (*memDAG, ipld.Node, map[string][]byte) {
+	ctx := context.Background()
+	dag := newMemDAG()
+	shard, err := hamt.NewShard(dag, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard.SetCidBuilder(testPrefix)
+	files := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("f%03d.txt", i)
+		files[name] = testData(name, 10+i)
+		if err = shard.Set(ctx, name, addFile(t, dag, files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files[filepath.Join("sub", "b.txt")] = testData("sharded b ", 1000)
+	sub := addDir(t, dag, map[string]ipld.Node{"b.txt": addFile(t, dag, files[filepath.Join("sub", "b.txt")])})
+	if err = shard.Set(ctx, "sub", sub); err != nil {
+		t.Fatal(err)
+	}
+	root, err := shard.Node()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dag, root, files
+}
+
+func TestVerifyPayloads(t *testing.T) {
+	payloads := map[string]func(t *testing.T) (*memDAG, ipld.Node, map[string][]byte){
+		"directory":         testPayload,
+		"sharded directory": shardedPayload,
+	}
+	for name, payloadOf := range payloads {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			dag, root, files := payloadOf(t)
+			output := t.TempDir()
+			writeFiles(t, output, files)
+			if err := verifyPayloads(ctx, dag, []payload{{cid: root.Cid()}}, output, 2); err != nil {
+				t.Fatal(err)
+			}
+
+			rel := filepath.Join("sub", "b.txt")
+			data := append([]byte(nil), files[rel]...)
+			data[len(data)-1] ^= 0xff
+			writeFiles(t, output, map[string][]byte{rel: data})
+			verifier := &payloadVerifier{dag: dag, outputDir: output, offsets: make(map[string]int64)}
+			err := verifier.verify(ctx, payload{cid: root.Cid()})
+			var payloadErr *PayloadError
+			if !errors.As(err, &payloadErr) || payloadErr.Err != nil || !payloadErr.Root.Equals(root.Cid()) || !payloadErr.Got.Defined() {
+				t.Fatalf("verify changed file: %v", err)
+			}
+
+			if err = os.Remove(filepath.Join(output, rel)); err != nil {
+				t.Fatal(err)
+			}
+			if err = verifyPayloads(ctx, dag, []payload{{cid: root.Cid()}}, output, 2); err == nil {
+				t.Fatal("verified without a file")
+			}
+		})
+	}
+}
+
+func TestVerifyFileRoot(t *testing.T) {
+	ctx := context.Background()
+	dag := newMemDAG()
+	data := testData("file root ", 5000)
+	root := addFile(t, dag, data)
+	output := t.TempDir()
+	writeFiles(t, output, map[string][]byte{root.Cid().String(): data})
+	if err := verifyPayloads(ctx, dag, []payload{{cid: root.Cid()}}, output, 1); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, output, map[string][]byte{root.Cid().String(): data[1:]})
+	if err := verifyPayloads(ctx, dag, []payload{{cid: root.Cid()}}, output, 1); err == nil {
+		t.Fatal("verified the truncated file")
+	}
+}
+
+// TestRestoreShardedDirectory restores and verifies the car of a HAMT sharded directory
+func TestRestoreShardedDirectory(t *testing.T) {
+	dag, root, files := shardedPayload(t)
+	carDir, output := t.TempDir(), t.TempDir()
+	writeFiles(t, carDir, map[string][]byte{"sharded.car": carData(t, dag, root.Cid(), nil)})
+	restorer, err := newUnixFSRestorer(&config.Config{Task: &config.Task{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := &Pipeline{Source: carDirSource{}, Restorer: restorer, Sink: noneSink{}}
+	job := &Job{CarDir: carDir, OutputDir: output, Cars: []*CarInfo{{CID: root.Cid().String()}}}
+	if _, err = pipeline.Run(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range files {
+		if got, err := os.ReadFile(filepath.Join(output, rel)); err != nil || string(got) != string(want) {
+			t.Fatalf("restored %s not matched: %v", rel, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package rebuilder
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sync"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+)
+
+// Job is a rebuild passed through the stages of a Pipeline
+type Job struct {
+	CarDir    string       // directory of the car files
+	OutputDir string       // directory of the restored files
+	Cars      []*CarInfo   // cars to rebuild, their payload cids must be restored if set
+	Progress  ProgressFunc // receiver of the progress events of all stages, nil to ignore
+}
+
+func (job *Job) report(p Progress) {
+	if job.Progress != nil {
+		job.Progress(p)
+	}
+}
+
+// Source gets the car files of the job into job.CarDir, found is called with the path of each car
+// once it is ready to restore, it may be called from multiple goroutines and blocks while the restorer is busy
+type Source interface {
+	Cars(ctx context.Context, job *Job, found func(path string)) error
+}
+
+// Restorer restores the car files received from cars into job.OutputDir until cars is closed or ctx is done,
+// it returns after all the received cars are restored, and nothing is uploaded if it failed
+type Restorer interface {
+	Restore(ctx context.Context, job *Job, cars <-chan string) error
+}
+
+// Sink stores the restored file at path, rel is its slash separated path relative to job.OutputDir,
+// the payload cid and download url of the stored file are returned if any
+type Sink interface {
+	Upload(ctx context.Context, job *Job, path, rel string) (payloadCid, downloadURL string, err error)
+}
+
+// Pipeline gets the car files from the source, restores them by the restorer and uploads the restored files to the sink
+type Pipeline struct {
+	Source    Source
+	Restorer  Restorer
+	Sink      Sink
+	Streaming bool // restore each car as soon as it is found instead of after all of them
+}
+
+// Run runs the job through the stages and returns the manifest of the uploaded files,
+// the source is stopped if the restorer failed, the manifest of the files uploaded is returned with
+// the error of a failed upload
+func (p *Pipeline) Run(ctx context.Context, job *Job) (manifest *Manifest, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cars := make(chan string)
+	done := make(chan error, 1)
+	go func() {
+		err := p.Restorer.Restore(ctx, job, cars)
+		if err != nil {
+			cancel()
+		}
+		done <- err
+	}()
+	send := func(path string) {
+		select {
+		case cars <- path:
+		case <-ctx.Done():
+		}
+	}
+
+	if p.Streaming {
+		log.Info("start getting car files with streaming restore ...")
+		err = p.Source.Cars(ctx, job, send)
+	} else {
+		log.Info("start getting car files ...")
+		var mu sync.Mutex
+		var paths []string
+		err = p.Source.Cars(ctx, job, func(path string) {
+			mu.Lock()
+			paths = append(paths, path)
+			mu.Unlock()
+		})
+		if err == nil {
+			log.Info("car files ready, start restore from car ...")
+			for _, path := range paths {
+				send(path)
+			}
+		}
+	}
+	if err != nil {
+		// stop the restorer without the cars not found
+		cancel()
+	}
+	close(cars)
+	if e := <-done; e != nil && (err == nil || !errors.Is(e, context.Canceled)) {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	log.Info("restore complete, start upload source file ...")
+	return p.upload(ctx, job)
+}
+
+// upload uploads the files in job.OutputDir to the sink, ctx is checked before each upload
+func (p *Pipeline) upload(ctx context.Context, job *Job) (manifest *Manifest, err error) {
+	manifest = new(Manifest)
+	err = filepath.WalkDir(job.OutputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(job.OutputDir, path)
+		if err != nil {
+			return err
+		}
+		var size int64
+		if info, e := d.Info(); e == nil {
+			size = info.Size()
+		}
+		sum, err := fileSha256(ctx, path)
+		if err != nil {
+			return err
+		}
+		log.Info("upload file :", path)
+		job.report(Progress{Stage: StageUpload, Job: path, Total: size})
+		payloadCid, downloadURL, err := p.Sink.Upload(ctx, job, path, filepath.ToSlash(rel))
+		progress := Progress{Stage: StageUpload, Job: path, Total: size, Finished: true, Err: err}
+		if err == nil {
+			progress.Done = size
+		}
+		job.report(progress)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, &ManifestFile{
+			Path:       filepath.ToSlash(rel),
+			Size:       size,
+			Sha256:     sum,
+			PayloadCid: payloadCid,
+			URL:        downloadURL,
+		})
+		return nil
+	})
+	return
+}
@@ -0,0 +1,143 @@
+package rebuilder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+)
+
+const (
+	// spaceReserve is the free space kept on each filesystem after download and restore
+	spaceReserve = 100 << 20
+	probeTimeout = 30 * time.Second
+)
+
+// SpaceError is returned when the free space of a path is not enough for the build
+type SpaceError struct {
+	Path string
+	Need uint64
+	Free uint64
+}
+
+func (e *SpaceError) Error() string {
+	return fmt.Sprintf("not enough disk space in %s, need %d bytes, free %d bytes, use force to ignore", e.Path, e.Need, e.Free)
+}
+
+// preflight checks the free space of carDir for the car files not downloaded yet, and of sourceDir
+// for the restored files which are estimated as the total size of cars, both are summed if on the same filesystem.
+// The car sizes are from metadata or HEAD requests in parallel, the probed sizes are kept in CarFileSize,
+// cars of unknown size, like the retrieved ones without url, are warned and not counted
+func (r *Rebuilder) preflight(ctx context.Context, carDir, sourceDir string, carInfos []*CarInfo) error {
+	unknown := 0
+	var remote []*CarInfo
+	for _, car := range carInfos {
+		if len(car.URLs()) == 0 {
+			unknown++
+			continue
+		}
+		remote = append(remote, car)
+	}
+	carInfos, err := uniqueCars(remote)
+	if err != nil {
+		return err
+	}
+	prober, parallel := NewHTTPFetcher(1).WithOptions(r.conf.Download), taskParallel(r.conf)
+	names := carFileNames(ctx, prober, parallel, carInfos)
+	parallelDo(len(carInfos), parallel, func(i int) {
+		// the probed size is kept in the car, which is verified by it after download instead of probing again
+		if car := carInfos[i]; car.CarFileSize <= 0 {
+			car.CarFileSize = probeSize(ctx, prober, car.URLs())
+		}
+	})
+	var downloadSize, restoreSize uint64
+	for i, car := range carInfos {
+		size := car.CarFileSize
+		if size <= 0 {
+			unknown++
+			continue
+		}
+		restoreSize += uint64(size)
+		if existing := existingSize(filepath.Join(carDir, names[i])); existing < size {
+			downloadSize += uint64(size - existing)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if unknown > 0 {
+		log.Warnf("size of %d car files unknown, not counted in disk space check", unknown)
+	}
+
+	carFree, carDev, err := diskUsage(carDir)
+	if err != nil {
+		log.Warn("check disk space failed: ", err)
+		return nil
+	}
+	sourceFree, sourceDev, err := diskUsage(sourceDir)
+	if err != nil {
+		log.Warn("check disk space failed: ", err)
+		return nil
+	}
+	log.Infof("disk space check, download %d bytes to %s (free %d), restore %d bytes to %s (free %d)",
+		downloadSize, carDir, carFree, restoreSize, sourceDir, sourceFree)
+	if carDev == sourceDev {
+		return r.checkSpace(sourceDir, downloadSize+restoreSize, sourceFree)
+	}
+	if err = r.checkSpace(carDir, downloadSize, carFree); err != nil {
+		return err
+	}
+	return r.checkSpace(sourceDir, restoreSize, sourceFree)
+}
+
+func (r *Rebuilder) checkSpace(path string, need, free uint64) error {
+	if need == 0 || need+spaceReserve <= free {
+		return nil
+	}
+	err := &SpaceError{Path: path, Need: need, Free: free}
+	if r.force {
+		log.Warn(err)
+		return nil
+	}
+	return err
+}
+
+// existingSize returns the size of the car file already at name, which is reused or resumed by the download
+func existingSize(name string) int64 {
+	for _, path := range []string{name, name + partSuffix} {
+		if stat, err := os.Stat(path); err == nil {
+			return stat.Size()
+		}
+	}
+	return 0
+}
+
+// probeSize returns the size of the first local file or content length of http url answering HEAD by prober,
+// or 0 if unknown
+func probeSize(ctx context.Context, prober *HTTPFetcher, urls []string) int64 {
+	for _, fileURL := range urls {
+		if path, ok, _ := localPath(fileURL); ok {
+			if stat, err := os.Stat(path); err == nil {
+				return stat.Size()
+			}
+			continue
+		}
+		if !strings.HasPrefix(fileURL, "http://") && !strings.HasPrefix(fileURL, "https://") {
+			continue
+		}
+		resp, err := prober.head(ctx, fileURL)
+		if err != nil {
+			log.Debugf("head %s failed: %v", redactURL(fileURL), err)
+			continue
+		}
+		if resp.StatusCode == http.StatusOK && resp.ContentLength > 0 {
+			return resp.ContentLength
+		}
+	}
+	return 0
+}
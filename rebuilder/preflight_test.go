@@ -0,0 +1,94 @@
+package rebuilder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+)
+
+const hugeSize = 1 << 60
+
+func TestPreflightSpace(t *testing.T) {
+	tests := []struct {
+		name     string
+		cars     []*CarInfo
+		existing int64 // bytes of a.car already in the car dir
+		force    bool
+		need     uint64 // 0 if passed
+	}{
+		{"small", []*CarInfo{{CarFileUrl: "http://a.example.com/a.car", CarFileSize: 100}}, 0, false, 0},
+		{"not enough", []*CarInfo{{CarFileUrl: "http://a.example.com/a.car", CarFileSize: hugeSize}}, 0, false, 2 * hugeSize},
+		{"existing not downloaded", []*CarInfo{{CarFileUrl: "http://a.example.com/a.car", CarFileSize: hugeSize}}, 100, false, 2*hugeSize - 100},
+		{"force", []*CarInfo{{CarFileUrl: "http://a.example.com/a.car", CarFileSize: hugeSize}}, 0, true, 0},
+		{"unknown not counted", []*CarInfo{{CID: "bafy1"}, {CarFileUrl: "file:///not/exist.car"}}, 0, false, 0},
+		{"duplicated counted once", []*CarInfo{
+			{CarFileUrl: "http://a.example.com/a.car", CarFileSize: hugeSize / 2},
+			{CarFileUrl: "http://a.example.com/a.car", CarFileSize: hugeSize / 2},
+		}, 0, false, hugeSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			carDir, sourceDir := t.TempDir(), t.TempDir()
+			if tt.existing > 0 {
+				if err := os.WriteFile(filepath.Join(carDir, "a.car"), make([]byte, tt.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := &Rebuilder{conf: &config.Config{Task: &config.Task{}}, force: tt.force}
+			err := r.preflight(context.Background(), carDir, sourceDir, tt.cars)
+			var spaceErr *SpaceError
+			switch {
+			case tt.need == 0 && err != nil:
+				t.Fatal(err)
+			case tt.need > 0 && !errors.As(err, &spaceErr):
+				t.Fatalf("preflight error %v, want space error", err)
+			case tt.need > 0 && spaceErr.Need != tt.need:
+				t.Fatalf("need %d, want %d", spaceErr.Need, tt.need)
+			}
+		})
+	}
+}
+
+// TestPreflightProbe probes the sizes of the cars in parallel with the headers of the download options,
+// the sizes are kept in the cars so the download does not probe again
+func TestPreflightProbe(t *testing.T) {
+	var heads int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&heads, 1)
+		if r.Method != http.MethodHead || r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(r.URL.Path)))
+	}))
+	defer srv.Close()
+	conf := &config.Config{
+		Task:     &config.Task{Parallel: 2},
+		Download: &config.Download{DownloadOptions: config.DownloadOptions{Headers: []string{"X-Token: secret"}}},
+	}
+	cars := []*CarInfo{
+		{CarFileUrl: srv.URL + "/a.car"},
+		{CarFileUrl: srv.URL + "/bb.car"},
+		{CarFileUrl: srv.URL + "/ccc.car", CarFileSize: 1000},
+	}
+	r := &Rebuilder{conf: conf}
+	if err := r.preflight(context.Background(), t.TempDir(), t.TempDir(), cars); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int64{int64(len("/a.car")), int64(len("/bb.car")), 1000} {
+		if cars[i].CarFileSize != want {
+			t.Errorf("car %d size %d, want %d", i, cars[i].CarFileSize, want)
+		}
+	}
+	if heads != 2 {
+		t.Fatalf("%d HEAD requests, want 2", heads)
+	}
+}
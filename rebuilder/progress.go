@@ -0,0 +1,80 @@
+package rebuilder
+
+import (
+	"time"
+)
+
+type Stage string
+
+const (
+	StageDownload Stage = "download"
+	StageRetrieve Stage = "retrieve"
+	StageRestore  Stage = "restore"
+	StageUpload   Stage = "upload"
+)
+
+const progressInterval = time.Second
+
+// Progress is an event of the job in a stage, Job is the url, cid or path the stage works on,
+// Total is 0 if unknown, Finished is set on the last event of the job with Err if it failed
+type Progress struct {
+	Stage    Stage
+	Job      string
+	Done     int64
+	Total    int64
+	Speed    int64 // bytes per second
+	ETA      time.Duration
+	Finished bool
+	Err      error
+}
+
+// Percent returns the completed percentage, or -1 if total is unknown
+func (p Progress) Percent() float64 {
+	if p.Total <= 0 {
+		return -1
+	}
+	return float64(p.Done) / float64(p.Total) * 100
+}
+
+// ProgressFunc receives progress events, it is called from multiple goroutines and should not block
+type ProgressFunc func(p Progress)
+
+// ProgressChan returns a ProgressFunc sending events to ch, the intermediate events are dropped when ch is full,
+// the Finished events block until received or done is closed, like the ctx.Done() of the job, so they are only
+// dropped after done is closed and a receiver gone never stalls the job
+func ProgressChan(ch chan<- Progress, done <-chan struct{}) ProgressFunc {
+	return func(p Progress) {
+		if p.Finished {
+			select {
+			case ch <- p:
+			case <-done:
+			}
+			return
+		}
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// speedometer calculates speed and eta from the samples of done bytes
+type speedometer struct {
+	last     int64
+	lastTime time.Time
+	speed    int64
+}
+
+func (m *speedometer) update(p *Progress) {
+	now := time.Now()
+	if !m.lastTime.IsZero() {
+		if elapsed := now.Sub(m.lastTime).Seconds(); elapsed > 0 && p.Done >= m.last {
+			m.speed = int64(float64(p.Done-m.last) / elapsed)
+		}
+	}
+	m.last, m.lastTime = p.Done, now
+	p.Speed = m.speed
+	if p.Speed > 0 && p.Total > p.Done {
+		p.ETA = time.Duration(float64(p.Total-p.Done)/float64(p.Speed)) * time.Second
+	}
+}
@@ -0,0 +1,60 @@
+package rebuilder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressChan(t *testing.T) {
+	tests := []struct {
+		name     string
+		finished bool
+		receive  bool // the full channel is received from after the send
+		closed   bool // done is closed after the send
+		sent     bool
+	}{
+		{"intermediate dropped", false, false, false, false},
+		{"finished received", true, true, false, true},
+		{"finished dropped after done", true, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, done := make(chan Progress, 1), make(chan struct{})
+			ch <- Progress{Job: "full"}
+			fn := ProgressChan(ch, done)
+			returned := make(chan struct{})
+			go func() {
+				defer close(returned)
+				fn(Progress{Job: "a", Finished: tt.finished})
+			}()
+			select {
+			case <-returned:
+				if tt.finished {
+					t.Fatal("finished event not blocked on the full channel")
+				}
+			case <-time.After(50 * time.Millisecond):
+				if !tt.finished {
+					t.Fatal("intermediate event blocked on the full channel")
+				}
+			}
+			if tt.receive {
+				<-ch
+			}
+			if tt.closed {
+				close(done)
+			}
+			select {
+			case <-returned:
+			case <-time.After(5 * time.Second):
+				t.Fatal("send not returned")
+			}
+			var jobs []string
+			for len(ch) > 0 {
+				jobs = append(jobs, (<-ch).Job)
+			}
+			if sent := len(jobs) > 0 && jobs[len(jobs)-1] == "a"; sent != tt.sent {
+				t.Fatalf("sent %v, want %v, received %v", sent, tt.sent, jobs)
+			}
+		})
+	}
+}
@@ -1,18 +1,16 @@
 package rebuilder
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
-	"github.com/FogMeta/rebuilder-tools/rebuilder/aria2"
 	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
 	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
-	"github.com/FogMeta/rebuilder-tools/rebuilder/lotus"
-	"github.com/FogMeta/rebuilder-tools/rebuilder/mcs"
-	"github.com/filedrive-team/go-graphsplit"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/s3"
 )
 
 func Init(confPath ...string) (rebuilder *Rebuilder, err error) {
@@ -23,22 +21,31 @@ func Init(confPath ...string) (rebuilder *Rebuilder, err error) {
 	return NewRebuilder(conf)
 }
 
-func Build(name string, fileURLs ...string) (downloadURL string, err error) {
+func Build(ctx context.Context, name string, fileURLs ...string) (manifest *Manifest, err error) {
 	rebuilder, err := Init()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return rebuilder.Build(name, fileURLs...)
+	defer rebuilder.Close()
+	return rebuilder.Build(ctx, name, fileURLs...)
 }
 
+// Rebuilder rebuilds the source files of car files by a Pipeline of the source, restorer and sink selected in conf
 type Rebuilder struct {
-	inputPath    string
-	outputPath   string
-	parallel     int
-	bucketClient *mcs.BucketClient
-	aria2Client  *aria2.Client
-	lotusClient  *lotus.Client
-	wallet       string
+	conf       *config.Config
+	inputPath  string
+	outputPath string
+	source     Source
+	mu         sync.Mutex
+	sources    map[string]Source // sources of BuildFrom by name, created on first use, guarded by mu
+	restorer   Restorer
+	sink       Sink
+	s3Client   *s3.Client
+	force      bool
+	streaming  bool
+	path       string
+	graph      GraphManifest
+	progress   ProgressFunc
 }
 
 func NewRebuilder(conf *config.Config) (r *Rebuilder, err error) {
@@ -48,161 +55,221 @@ func NewRebuilder(conf *config.Config) (r *Rebuilder, err error) {
 	if conf.Task == nil {
 		return nil, errors.New("conf not set task")
 	}
-	parallet := conf.Task.Parallel
-	if parallet == 0 {
-		parallet = 3
-	}
 
-	// init aria2 client
-	if conf.Aria2 == nil {
-		return nil, errors.New("conf not set aria2")
+	// init stages
+	source, restorer, sink, err := newStages(conf)
+	if err != nil {
+		return
 	}
-	aria2Client := aria2.NewClient(conf.Aria2.Host, conf.Aria2.Port, conf.Aria2.Secret)
-
-	// init mcs
-	if conf.MCS == nil {
-		return nil, errors.New("conf not set mcs")
+	sourceName := conf.Task.Source
+	if sourceName == "" {
+		sourceName = SourceDownload
 	}
-	bucketClient, err := mcs.NewBucketClient(conf.MCS.APIKey, conf.MCS.APIToken, conf.MCS.Network, conf.MCS.BucketName)
-	if err != nil {
+	r = &Rebuilder{
+		conf:       conf,
+		inputPath:  conf.Task.InputPath,
+		outputPath: conf.Task.OutputPath,
+		source:     source,
+		sources:    map[string]Source{sourceName: source},
+		restorer:   restorer,
+		sink:       sink,
+		force:      conf.Task.Force,
+		streaming:  conf.Task.Streaming,
+		path:       cleanDataPath(conf.Task.Path),
+	}
+	defer func() {
+		if err != nil {
+			r.Close()
+			r = nil
+		}
+	}()
+
+	// init s3
+	if r.s3Client, err = newS3Client(conf); err != nil {
 		return
 	}
 
-	// init lotus
-	var lotusClient *lotus.Client
-	wallet := ""
-	if conf.Lotus != nil {
-		wallet = conf.Lotus.Wallet
-		lotusClient, err = lotus.NewClient(conf.Lotus.NodeApi, conf.Lotus.Timeout)
-		if err != nil {
+	// init graphsplit manifest
+	if conf.Task.GraphManifest != "" {
+		if r.graph, err = ReadGraphManifest(conf.Task.GraphManifest); err != nil {
 			return
 		}
-	} else {
-		log.Warn("conf not set lotus")
 	}
-
-	return &Rebuilder{
-		inputPath:    conf.Task.InputPath,
-		outputPath:   conf.Task.OutputPath,
-		parallel:     parallet,
-		bucketClient: bucketClient,
-		aria2Client:  aria2Client,
-		lotusClient:  lotusClient,
-		wallet:       wallet,
-	}, nil
+	return r, nil
 }
 
-// Build builds source file from car file url
-func (r *Rebuilder) Build(name string, fileURLs ...string) (downloadURL string, err error) {
-	if len(fileURLs) == 0 {
-		return "", errors.New("no file URLs")
+// Close closes the stages implementing io.Closer, like the aria2 client and the local aria2 started by the download source
+func (r *Rebuilder) Close() (err error) {
+	stages := []interface{}{r.restorer, r.sink}
+	r.mu.Lock()
+	for _, source := range r.sources {
+		stages = append(stages, source)
 	}
-	if r.inputPath == r.outputPath {
-		return "", errors.New("input path not be same with output path")
+	r.mu.Unlock()
+	for _, stage := range stages {
+		if e := closeStage(stage); e != nil {
+			err = e
+		}
 	}
-	if name == "" {
-		name = filepath.Base(fileURLs[0])
+	return
+}
+
+// OnProgress sets the receiver of progress events of download, retrieve, restore and upload,
+// fn is called by the workers and blocks them, see ProgressChan to receive the events from a channel
+func (r *Rebuilder) OnProgress(fn ProgressFunc) {
+	r.progress = fn
+}
+
+func (r *Rebuilder) report(p Progress) {
+	if r.progress != nil {
+		r.progress(p)
 	}
+}
 
-	sourceDir := filepath.Join(r.outputPath, name)
-	if err = os.MkdirAll(sourceDir, 0766); err != nil {
-		return
+// Build builds source file from car file url
+func (r *Rebuilder) Build(ctx context.Context, name string, fileURLs ...string) (manifest *Manifest, err error) {
+	carInfos := make([]*CarInfo, 0, len(fileURLs))
+	for _, fileURL := range fileURLs {
+		carInfos = append(carInfos, &CarInfo{CarFileUrl: fileURL})
 	}
+	return r.BuildCars(ctx, name, carInfos)
+}
 
-	carDir := filepath.Join(r.inputPath, name)
-	if err = os.MkdirAll(carDir, 0766); err != nil {
+// BuildCars builds source file from car files, each car is downloaded from its url and mirrors,
+// in-flight downloads are removed when ctx is canceled
+func (r *Rebuilder) BuildCars(ctx context.Context, name string, carInfos []*CarInfo) (manifest *Manifest, err error) {
+	return r.build(ctx, name, carInfos, r.source)
+}
+
+// BuildFrom builds source file from car files got by the source registered as source instead of the one in conf,
+// like SourceGateway downloading the cars of the payload cids from the ipfs gateways, or SourceRetrieve
+// retrieving them from their deals
+func (r *Rebuilder) BuildFrom(ctx context.Context, source, name string, carInfos []*CarInfo) (manifest *Manifest, err error) {
+	s, err := r.sourceOf(source)
+	if err != nil {
 		return
 	}
+	return r.build(ctx, name, carInfos, s)
+}
 
-	log.Info("start download ...")
-	//download car file
-	downloader := NewDownloader(r.parallel, r.aria2Client)
-	_, err = downloader.DownloadFiles(carDir, fileURLs...)
+// sourceOf returns the source registered as name, which is created by the conf of the rebuilder on first use,
+// it is safe to call from multiple goroutines
+func (r *Rebuilder) sourceOf(name string) (Source, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if source, ok := r.sources[name]; ok {
+		return source, nil
+	}
+	source, err := newSource(r.conf, name)
 	if err != nil {
-		return
+		return nil, err
 	}
-	log.Info("download complete, start restore from car ...")
-	return r.RestoreAndUpload(carDir, sourceDir)
+	r.sources[name] = source
+	return source, nil
 }
 
-func (r *Rebuilder) RestoreAndUpload(carPath, outputDir string) (downloadURL string, err error) {
-	// restore from car
-	graphsplit.CarTo(carPath, outputDir, r.parallel)
-	graphsplit.Merge(outputDir, r.parallel, true)
-	log.Info("restore complete, start upload source file ...")
-	// upload file
-	err = filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+// expandS3 replaces each car of s3://bucket/prefix/ url, which ends with "/", by the .car objects under the prefix
+func (r *Rebuilder) expandS3(ctx context.Context, carInfos []*CarInfo) ([]*CarInfo, error) {
+	var cars []*CarInfo
+	for _, car := range carInfos {
+		bucket, prefix, ok := s3.ParseURL(car.CarFileUrl)
+		if !ok || prefix != "" && !strings.HasSuffix(prefix, "/") {
+			cars = append(cars, car)
+			continue
+		}
+		if r.s3Client == nil {
+			return nil, errors.New("conf not set s3")
+		}
+		objects, err := r.s3Client.List(ctx, bucket, prefix)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if d.IsDir() {
-			return nil
+		found := 0
+		for _, object := range objects {
+			if !strings.EqualFold(filepath.Ext(object.Key), carExt) {
+				continue
+			}
+			cars = append(cars, &CarInfo{CarFileUrl: s3.Scheme + bucket + "/" + object.Key, CarFileSize: object.Size})
+			found++
 		}
-		log.Info("upload file :", path)
-		downloadURL, err = r.bucketClient.UploadFile(path, true)
-		return err
-	})
-	return
+		log.Infof("found %d car files in %s", found, car.CarFileUrl)
+	}
+	return cars, nil
 }
 
-func (r *Rebuilder) Retrieve(name string, carInfos []*CarInfo, wallet string, savePath ...string) (downloadURL string, err error) {
+func (r *Rebuilder) build(ctx context.Context, name string, carInfos []*CarInfo, source Source) (manifest *Manifest, err error) {
+	if carInfos, err = r.expandS3(ctx, carInfos); err != nil {
+		return
+	}
 	if len(carInfos) == 0 {
-		return "", errors.New("invalid empty carInfos")
+		return nil, errors.New("no file URLs")
 	}
-
-	carDir := filepath.Join(r.inputPath, name)
-	if err = os.MkdirAll(carDir, 0766); err != nil {
-		return
+	if r.inputPath == r.outputPath {
+		return nil, errors.New("input path not be same with output path")
 	}
-	for _, info := range carInfos {
-		if info.CID == "" || len(info.Deals) == 0 {
-			return "", errors.New("invalid empty cid or miners")
-		}
-		success := false
-		for _, deal := range info.Deals {
-			cid, miner := info.CID, deal.MinerFid
-			if err := r.RetrieveFile(cid, miner, wallet, carDir); err == nil {
-				log.Infof("retrieve file %s with miner :%s success\n", cid, miner)
-				success = true
-				break
-			} else {
-				log.Errorf("retrieve file %s with miner :%s failed: %v\n", cid, miner, err)
-			}
-		}
-		if !success {
-			log.Errorf("retrieve file %s with all miners failed: %v\n", info.CID, err)
-			return "", fmt.Errorf("retrieve failed with file :%s", info.CID)
+	if r.path != "" && r.graph != nil {
+		if carInfos, err = r.graph.selectCars(carInfos, r.path); err != nil {
+			return
 		}
 	}
-	path := r.outputPath
-	if len(savePath) > 0 && savePath[0] != "" {
-		path = savePath[0]
+	if name == "" {
+		// the name of the first url, or the payload cid of the cars without url
+		if urls := carInfos[0].URLs(); len(urls) > 0 {
+			name = filepath.Base(urls[0])
+		} else if name = carInfos[0].CID; name == "" {
+			return nil, errors.New("no file URLs or payload cid")
+		}
 	}
-	sourceDir := filepath.Join(path, name)
+
+	sourceDir := filepath.Join(r.outputPath, name)
 	if err = os.MkdirAll(sourceDir, 0766); err != nil {
 		return
 	}
-	return r.RestoreAndUpload(carDir, sourceDir)
-}
 
-func (r *Rebuilder) RetrieveFile(cid, miner string, wallet string, savePath string) (err error) {
-	if r.lotusClient == nil {
-		return errors.New("conf net set lotus")
-	}
-	if cid == "" || miner == "" {
-		return errors.New("invalid empty cid or miner")
+	carDir := filepath.Join(r.inputPath, name)
+	if err = os.MkdirAll(carDir, 0766); err != nil {
+		return
 	}
-	if wallet == "" {
-		wallet = r.wallet
+
+	if err = r.preflight(ctx, carDir, sourceDir, carInfos); err != nil {
+		return
 	}
-	path := filepath.Join(savePath, fmt.Sprintf("%s-%s.car", miner, cid))
-	return r.lotusClient.RetrieveData(miner, cid, path, wallet)
+
+	return r.pipeline(source).Run(ctx, &Job{CarDir: carDir, OutputDir: sourceDir, Cars: carInfos, Progress: r.progress})
+}
+
+// pipeline returns the pipeline from source to the restorer and sink of the rebuilder
+func (r *Rebuilder) pipeline(source Source) *Pipeline {
+	return &Pipeline{Source: source, Restorer: r.restorer, Sink: r.sink, Streaming: r.streaming}
+}
+
+// RestoreAndUpload restores source files from the car files in carPath and uploads them,
+// nothing is uploaded if any car failed to restore, see RestoreError
+func (r *Rebuilder) RestoreAndUpload(ctx context.Context, carPath, outputDir string) (manifest *Manifest, err error) {
+	return r.pipeline(carDirSource{}).Run(ctx, &Job{CarDir: carPath, OutputDir: outputDir, Progress: r.progress})
 }
 
 type CarInfo struct {
-	CarFileUrl string     `json:"CarFileUrl"`
-	CID        string     `json:"PayloadCid"`
-	Deals      []*CarDeal `json:"Deals"`
+	CarFileUrl    string     `json:"CarFileUrl"`
+	Mirrors       []string   `json:"Mirrors"`
+	CarFileSize   int64      `json:"CarFileSize"`
+	CarFileSha256 string     `json:"CarFileSha256"`
+	PieceCid      string     `json:"PieceCid"`
+	CID           string     `json:"PayloadCid"`
+	Deals         []*CarDeal `json:"Deals"`
+}
+
+// URLs returns the non-empty CarFileUrl and mirrors without duplicates
+func (info *CarInfo) URLs() (urls []string) {
+	m := make(map[string]bool)
+	for _, u := range append([]string{info.CarFileUrl}, info.Mirrors...) {
+		if u == "" || m[u] {
+			continue
+		}
+		m[u] = true
+		urls = append(urls, u)
+	}
+	return
 }
 
 type CarDeal struct {
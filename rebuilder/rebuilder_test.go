@@ -0,0 +1,143 @@
+package rebuilder
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+	"github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	"github.com/ipfs/go-unixfs/importer/helpers"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+)
+
+func TestMain(m *testing.M) {
+	if err := log.Init(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// memDAG keeps the nodes of the test dags in the order added
+type memDAG struct {
+	nodes map[cid.Cid]ipld.Node
+	order []cid.Cid
+}
+
+func newMemDAG() *memDAG {
+	return &memDAG{nodes: make(map[cid.Cid]ipld.Node)}
+}
+
+func (dag *memDAG) Get(_ context.Context, c cid.Cid) (ipld.Node, error) {
+	if nd, ok := dag.nodes[c]; ok {
+		return nd, nil
+	}
+	return nil, ipld.ErrNotFound{Cid: c}
+}
+
+func (dag *memDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	for _, c := range cids {
+		nd, err := dag.Get(ctx, c)
+		out <- &ipld.NodeOption{Node: nd, Err: err}
+	}
+	close(out)
+	return out
+}
+
+func (dag *memDAG) Add(_ context.Context, nd ipld.Node) error {
+	if _, ok := dag.nodes[nd.Cid()]; !ok {
+		dag.nodes[nd.Cid()] = nd
+		dag.order = append(dag.order, nd.Cid())
+	}
+	return nil
+}
+
+func (dag *memDAG) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		dag.Add(ctx, nd)
+	}
+	return nil
+}
+
+func (dag *memDAG) Remove(context.Context, cid.Cid) error {
+	return errDiscardDAG
+}
+
+func (dag *memDAG) RemoveMany(context.Context, []cid.Cid) error {
+	return errDiscardDAG
+}
+
+var testPrefix = cid.Prefix{Version: 1, Codec: cid.DagProtobuf, MhType: 0x12, MhLength: -1}
+
+// addFile adds the file dag of data with small raw leaves so it has more than one level
+func addFile(t *testing.T, dag *memDAG, data []byte) ipld.Node {
+	t.Helper()
+	params := helpers.DagBuilderParams{Maxlinks: 4, RawLeaves: true, CidBuilder: testPrefix, Dagserv: dag}
+	db, err := params.New(chunker.NewSizeSplitter(bytes.NewReader(data), 256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := balanced.Layout(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nd
+}
+
+// addDir adds the basic directory of the entries
+func addDir(t *testing.T, dag *memDAG, entries map[string]ipld.Node) ipld.Node {
+	t.Helper()
+	ctx := context.Background()
+	dir := uio.NewDirectory(dag)
+	dir.SetCidBuilder(testPrefix)
+	for name, nd := range entries {
+		if err := dir.AddChild(ctx, name, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dag.Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+	return nd
+}
+
+// carData returns the CARv1 of root with root as the first block and the other nodes of dag after it,
+// tamper changes the data of the blocks if not nil
+func carData(t *testing.T, dag *memDAG, root cid.Cid, tamper func(c cid.Cid, data []byte) []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	cids := append([]cid.Cid{root}, dag.order...)
+	seen := cid.NewSet()
+	for _, c := range cids {
+		if !seen.Visit(c) {
+			continue
+		}
+		data := dag.nodes[c].RawData()
+		if tamper != nil {
+			data = tamper(c, append([]byte(nil), data...))
+		}
+		if err := util.LdWrite(&buf, c.Bytes(), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// testData returns size bytes of the repeated pattern of seed
+func testData(seed string, size int) []byte {
+	return bytes.Repeat([]byte(seed), size/len(seed)+1)[:size]
+}
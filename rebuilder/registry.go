@@ -0,0 +1,150 @@
+package rebuilder
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+)
+
+// names of the built-in stages
+const (
+	SourceDownload     = "download"
+	SourceGateway      = "gateway"
+	SourceLocal        = "local"
+	SourceCarDir       = "cardir"
+	SourceRetrieve     = "retrieve"
+	RestorerGraphsplit = "graphsplit" // the unixfs restorer writing the files by graphsplit
+	RestorerUnixFS     = "unixfs"
+	SinkMCS            = "mcs"
+	SinkNone           = "none"
+)
+
+// factories create the stages from the config, a stage implementing io.Closer is closed with the Rebuilder
+type (
+	SourceFactory   func(conf *config.Config) (Source, error)
+	RestorerFactory func(conf *config.Config) (Restorer, error)
+	SinkFactory     func(conf *config.Config) (Sink, error)
+)
+
+var registry = struct {
+	sync.RWMutex
+	sources   map[string]SourceFactory
+	restorers map[string]RestorerFactory
+	sinks     map[string]SinkFactory
+}{
+	sources:   make(map[string]SourceFactory),
+	restorers: make(map[string]RestorerFactory),
+	sinks:     make(map[string]SinkFactory),
+}
+
+func init() {
+	RegisterSource(SourceDownload, newDownloadSourceFromConf)
+	RegisterSource(SourceGateway, newGatewaySource)
+	RegisterSource(SourceLocal, newLocalSource)
+	RegisterSource(SourceCarDir, func(*config.Config) (Source, error) {
+		return carDirSource{}, nil
+	})
+	RegisterSource(SourceRetrieve, newRetrieveSource)
+	RegisterRestorer(RestorerGraphsplit, newGraphsplitRestorer)
+	RegisterRestorer(RestorerUnixFS, newUnixFSRestorer)
+	RegisterSink(SinkMCS, newMCSSink)
+	RegisterSink(SinkNone, func(*config.Config) (Sink, error) {
+		return noneSink{}, nil
+	})
+}
+
+// RegisterSource registers the source selected by name in the source of [task], a registered name is replaced
+func RegisterSource(name string, factory SourceFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.sources[name] = factory
+}
+
+// RegisterRestorer registers the restorer selected by name in the restorer of [task], a registered name is replaced
+func RegisterRestorer(name string, factory RestorerFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.restorers[name] = factory
+}
+
+// RegisterSink registers the sink selected by name in the sink of [task], a registered name is replaced
+func RegisterSink(name string, factory SinkFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.sinks[name] = factory
+}
+
+// newStages creates the source, restorer and sink selected in conf, download, graphsplit and mcs by default
+func newStages(conf *config.Config) (source Source, restorer Restorer, sink Sink, err error) {
+	sourceName, restorerName, sinkName := conf.Task.Source, conf.Task.Restorer, conf.Task.Sink
+	if sourceName == "" {
+		sourceName = SourceDownload
+	}
+	if restorerName == "" {
+		restorerName = RestorerGraphsplit
+	}
+	if sinkName == "" {
+		sinkName = SinkMCS
+	}
+	registry.RLock()
+	sourceFactory, sourceOk := registry.sources[sourceName]
+	restorerFactory, restorerOk := registry.restorers[restorerName]
+	sinkFactory, sinkOk := registry.sinks[sinkName]
+	registry.RUnlock()
+	switch {
+	case !sourceOk:
+		return nil, nil, nil, fmt.Errorf("not supported source: %s", sourceName)
+	case !restorerOk:
+		return nil, nil, nil, fmt.Errorf("not supported restorer: %s", restorerName)
+	case !sinkOk:
+		return nil, nil, nil, fmt.Errorf("not supported sink: %s", sinkName)
+	}
+
+	if source, err = sourceFactory(conf); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			closeStage(source)
+		}
+	}()
+	if restorer, err = restorerFactory(conf); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			closeStage(restorer)
+		}
+	}()
+	sink, err = sinkFactory(conf)
+	return
+}
+
+// newSource creates the source registered as name
+func newSource(conf *config.Config, name string) (Source, error) {
+	registry.RLock()
+	factory, ok := registry.sources[name]
+	registry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("not supported source: %s", name)
+	}
+	return factory(conf)
+}
+
+// closeStage closes the stage if it is an io.Closer
+func closeStage(stage interface{}) error {
+	if closer, ok := stage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// taskParallel returns the parallel of the task, 3 by default
+func taskParallel(conf *config.Config) int {
+	if conf.Task.Parallel <= 0 {
+		return 3
+	}
+	return conf.Task.Parallel
+}
@@ -0,0 +1,112 @@
+package rebuilder
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+)
+
+// TestBuildFromLocal builds the local cars by the local source selected in conf, the cars of other urls are not downloaded
+func TestBuildFromLocal(t *testing.T) {
+	dag, root, files := testPayload(t)
+	dir := t.TempDir()
+	carPath := filepath.Join(dir, "cars", "payload.car")
+	writeFiles(t, filepath.Dir(carPath), map[string][]byte{"payload.car": carData(t, dag, root.Cid(), nil)})
+	conf := &config.Config{Task: &config.Task{
+		InputPath:  filepath.Join(dir, "input"),
+		OutputPath: filepath.Join(dir, "output"),
+		Source:     SourceLocal,
+		Sink:       SinkNone,
+		LocalMode:  LocalModeCopy,
+	}}
+	builder, err := NewRebuilder(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Close()
+
+	_, err = builder.BuildCars(context.Background(), "remote", []*CarInfo{{CarFileUrl: "http://127.0.0.1:1/payload.car"}})
+	var notLocalErr *notLocalError
+	if !errors.As(err, &notLocalErr) {
+		t.Fatalf("build remote car by local source: %v", err)
+	}
+
+	cars, err := LocalCars(filepath.Dir(carPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = builder.BuildCars(context.Background(), "payload", cars); err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range files {
+		if got, err := os.ReadFile(filepath.Join(conf.Task.OutputPath, "payload", rel)); err != nil || string(got) != string(want) {
+			t.Fatalf("rebuilt %s not matched: %v", rel, err)
+		}
+	}
+}
+
+func TestBuildFromNotConfigured(t *testing.T) {
+	dir := t.TempDir()
+	conf := &config.Config{Task: &config.Task{
+		InputPath:  filepath.Join(dir, "input"),
+		OutputPath: filepath.Join(dir, "output"),
+		Fetcher:    "http",
+		Sink:       SinkNone,
+	}}
+	builder, err := NewRebuilder(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Close()
+	cars := []*CarInfo{{CID: "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi", Deals: []*CarDeal{{MinerFid: "f01000"}}}}
+	for source, want := range map[string]string{
+		SourceRetrieve: "conf not set lotus",
+		SourceGateway:  "conf not set gateway",
+		"unknown":      "not supported source: unknown",
+	} {
+		if _, err = builder.BuildFrom(context.Background(), source, "", cars); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("build from %s: %v, want %s", source, err, want)
+		}
+	}
+}
+
+// TestSourceOfConcurrent gets the sources of BuildFrom from multiple goroutines, each source is created once
+func TestSourceOfConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	builder, err := NewRebuilder(&config.Config{Task: &config.Task{
+		InputPath:  filepath.Join(dir, "input"),
+		OutputPath: filepath.Join(dir, "output"),
+		Fetcher:    "http",
+		Sink:       SinkNone,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Close()
+	names := []string{SourceLocal, SourceCarDir, SourceDownload}
+	sources := make([]Source, 8*len(names))
+	var wg sync.WaitGroup
+	for i := range sources {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			source, err := builder.sourceOf(names[i%len(names)])
+			if err != nil {
+				t.Error(err)
+			}
+			sources[i] = source
+		}(i)
+	}
+	wg.Wait()
+	for i, source := range sources {
+		if source != sources[i%len(names)] {
+			t.Fatalf("source %s created more than once", names[i%len(names)])
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package rebuilder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/restore"
+	"github.com/filedrive-team/go-graphsplit"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// carPaddingFileName is the placeholder graphsplit adds to pad small cars, removed after restore
+	carPaddingFileName = "___car___.placeholder"
+	chunkSuffixFormat  = "%s.%08d"
+	firstChunkSuffix   = ".00000000"
+)
+
+// CarError is the failure of restoring one car
+type CarError struct {
+	Path string
+	Root cid.Cid // undefined if the car is not imported
+	Err  error
+}
+
+func (e *CarError) Error() string {
+	if e.Root.Defined() {
+		return fmt.Sprintf("%s (root %s): %v", e.Path, e.Root, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *CarError) Unwrap() error {
+	return e.Err
+}
+
+// RestoreError is returned when any car failed to restore, any expected payload cid is not restored
+// or the path to rebuild is not found, nothing is uploaded after it
+type RestoreError struct {
+	Cars  []*CarError
+	Roots []string // expected payload cids not restored from any car
+	Path  string   // path to rebuild not found under any restored root
+}
+
+func (e *RestoreError) Error() string {
+	var msgs []string
+	for _, car := range e.Cars {
+		msgs = append(msgs, car.Error())
+	}
+	if len(e.Roots) > 0 {
+		msgs = append(msgs, "payload cids not restored: "+strings.Join(e.Roots, ", "))
+	}
+	if e.Path != "" {
+		msgs = append(msgs, fmt.Sprintf("%s not found in any car", e.Path))
+	}
+	return "restore failed: " + strings.Join(msgs, "; ")
+}
+
+// carRestorer restores the car files added while they are downloaded, a root with blocks
+// not added yet is restored again after all the cars are added, only the path and its graphsplit chunks
+// are restored from each root if path is set
+type carRestorer struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	outputDir string
+	path      string
+	store     *restore.Restorer
+	jobs      chan string
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	failures  []*CarError
+	pending   []*CarError           // roots with missing blocks
+	payloads  map[cid.Cid][]payload // written payloads of each restored root
+	progress  ProgressFunc
+}
+
+// newCarRestorer starts parallel workers restoring the added cars into outputDir until wait is called,
+// cancel is called on the first failure to stop the downloads if not nil, the files are written by graphsplit if set
+func newCarRestorer(ctx context.Context, cancel context.CancelFunc, outputDir, path string, parallel int, byGraphsplit bool, progress ProgressFunc) *carRestorer {
+	if parallel <= 0 {
+		parallel = 1
+	}
+	store := restore.NewRestorer()
+	if byGraphsplit {
+		store.WithWriter(graphsplit.NodeWriteTo)
+	}
+	restorer := &carRestorer{
+		ctx:       ctx,
+		cancel:    cancel,
+		outputDir: outputDir,
+		path:      path,
+		store:     store,
+		jobs:      make(chan string),
+		payloads:  make(map[cid.Cid][]payload),
+		progress:  progress,
+	}
+	for i := 0; i < parallel; i++ {
+		restorer.wg.Add(1)
+		go func() {
+			defer restorer.wg.Done()
+			for path := range restorer.jobs {
+				restorer.restore(path)
+			}
+		}()
+	}
+	return restorer
+}
+
+// add queues the car at path, it blocks while all workers are busy
+func (restorer *carRestorer) add(path string) {
+	select {
+	case <-restorer.ctx.Done():
+	case restorer.jobs <- path:
+	}
+}
+
+// wait waits for the added cars restored and restores the pending roots, then checks the payload cids
+// of carInfos are restored, a *RestoreError is returned listing the failed cars and the payload cids not restored
+func (restorer *carRestorer) wait(carInfos []*CarInfo) error {
+	close(restorer.jobs)
+	restorer.wg.Wait()
+	if len(restorer.failures) == 0 {
+		if err := restorer.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	for _, pending := range restorer.pending {
+		if restorer.ctx.Err() != nil {
+			break
+		}
+		restorer.writeRoot(pending.Path, pending.Root, true)
+	}
+	restoreErr := &RestoreError{Cars: restorer.failures}
+	seen := make(map[string]bool)
+	for _, car := range carInfos {
+		if car.CID == "" || seen[car.CID] {
+			continue
+		}
+		seen[car.CID] = true
+		if root, err := cid.Parse(car.CID); err != nil || restorer.payloads[root] == nil {
+			restoreErr.Roots = append(restoreErr.Roots, car.CID)
+		}
+	}
+	if restorer.path != "" && len(restoreErr.Cars) == 0 && len(restorer.restored()) == 0 {
+		restoreErr.Path = restorer.path
+	}
+	if len(restoreErr.Cars) > 0 || len(restoreErr.Roots) > 0 || restoreErr.Path != "" {
+		return restoreErr
+	}
+	return nil
+}
+
+func (restorer *carRestorer) restore(path string) {
+	if restorer.ctx.Err() != nil {
+		return
+	}
+	restorer.report(Progress{Stage: StageRestore, Job: path})
+	roots, err := restorer.store.Add(restorer.ctx, path)
+	if err != nil {
+		err = fmt.Errorf("import car: %w", err)
+		restorer.fail(&CarError{Path: path, Err: err})
+	}
+	for _, root := range roots {
+		restorer.writeRoot(path, root, false)
+	}
+	restorer.report(Progress{Stage: StageRestore, Job: path, Finished: true, Err: err})
+}
+
+// writeRoot writes the files of root in the car at path, the root with missing blocks is pending
+// for the cars not added yet unless final
+func (restorer *carRestorer) writeRoot(path string, root cid.Cid, final bool) {
+	payloads, err := restorer.write(root)
+	var missingErr *restore.MissingBlocksError
+	if err != nil && !final && errors.As(err, &missingErr) {
+		log.Debugf("restore %s of %s later: %v", root, path, err)
+		restorer.mu.Lock()
+		restorer.pending = append(restorer.pending, &CarError{Path: path, Root: root, Err: err})
+		restorer.mu.Unlock()
+		return
+	}
+	if err != nil {
+		restorer.fail(&CarError{Path: path, Root: root, Err: err})
+		return
+	}
+	restorer.mu.Lock()
+	restorer.payloads[root] = payloads
+	restorer.mu.Unlock()
+	log.Infof("restored %s of car %s", root, path)
+}
+
+// write writes the files of root, or only the entries at the path and its chunks under root,
+// and returns the payloads written, a root without the path is restored with nothing written
+func (restorer *carRestorer) write(root cid.Cid) ([]payload, error) {
+	if restorer.path == "" {
+		return []payload{{cid: root}}, restorer.store.WriteTo(restorer.ctx, root, restorer.outputDir)
+	}
+	dir, name := path.Split(restorer.path)
+	dir = strings.TrimSuffix(dir, "/")
+	names, err := restorer.store.Entries(restorer.ctx, root, dir)
+	if errors.Is(err, restore.ErrNotFound) {
+		log.Debugf("%s not in %s: %v", restorer.path, root, err)
+		return []payload{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	payloads := []payload{}
+	for _, entry := range names {
+		if merged, _, ok := chunkOf(entry); entry != name && (!ok || merged != name) {
+			continue
+		}
+		rel := path.Join(dir, entry)
+		c, err := restorer.store.WritePath(restorer.ctx, root, rel, restorer.outputDir)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload{cid: c, rel: filepath.FromSlash(rel)})
+	}
+	return payloads, nil
+}
+
+// fail records the failure and stops the downloads, failures after ctx done are ignored
+func (restorer *carRestorer) fail(carErr *CarError) {
+	if restorer.ctx.Err() != nil {
+		return
+	}
+	log.Errorf("restore %s failed: %v", carErr.Path, carErr.Err)
+	restorer.mu.Lock()
+	restorer.failures = append(restorer.failures, carErr)
+	restorer.mu.Unlock()
+	if restorer.cancel != nil {
+		restorer.cancel()
+	}
+}
+
+func (restorer *carRestorer) report(p Progress) {
+	if restorer.progress != nil {
+		restorer.progress(p)
+	}
+}
+
+// unixfsRestorer restores the UnixFS files of the car roots by restore.Restorer, merges the chunked files
+// of graphsplit and verifies the files reproduce the restored roots
+type unixfsRestorer struct {
+	parallel     int
+	path         string
+	byGraphsplit bool // write the restored files by graphsplit
+	skipVerify   bool
+}
+
+func newUnixFSRestorer(conf *config.Config) (Restorer, error) {
+	return newCarFileRestorer(conf, false), nil
+}
+
+// newGraphsplitRestorer returns the unixfs restorer writing the restored files by graphsplit
+func newGraphsplitRestorer(conf *config.Config) (Restorer, error) {
+	return newCarFileRestorer(conf, true), nil
+}
+
+func newCarFileRestorer(conf *config.Config, byGraphsplit bool) *unixfsRestorer {
+	return &unixfsRestorer{
+		parallel:     taskParallel(conf),
+		path:         cleanDataPath(conf.Task.Path),
+		byGraphsplit: byGraphsplit,
+		skipVerify:   conf.Task.SkipVerify,
+	}
+}
+
+// Restore restores each car received as soon as possible, the first failure stops receiving
+func (r *unixfsRestorer) Restore(ctx context.Context, job *Job, cars <-chan string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	restorer := newCarRestorer(ctx, cancel, job.OutputDir, r.path, r.parallel, r.byGraphsplit, job.Progress)
+	// the cars are kept open until the payloads are verified
+	defer restorer.store.Close()
+receive:
+	for {
+		select {
+		case path, ok := <-cars:
+			if !ok {
+				break receive
+			}
+			restorer.add(path)
+		case <-ctx.Done():
+			break receive
+		}
+	}
+	if err := restorer.wait(job.Cars); err != nil {
+		return err
+	}
+	return r.complete(ctx, restorer, job.OutputDir)
+}
+
+// complete merges the chunked files in outputDir, then verifies the files reproduce the restored roots unless skip verify
+func (r *unixfsRestorer) complete(ctx context.Context, restorer *carRestorer, outputDir string) error {
+	log.Info("restore complete, start merge ...")
+	if err := mergeChunks(ctx, outputDir, r.parallel); err != nil {
+		return err
+	}
+	if r.skipVerify {
+		log.Warn("skip verifying payload cids of the rebuilt files")
+		return nil
+	}
+	log.Info("verify payload cids of the rebuilt files ...")
+	return verifyPayloads(ctx, restorer.store.DAG(), restorer.restored(), outputDir, r.parallel)
+}
+
+// restored returns the written payloads of the restored roots in the order of cars added
+func (restorer *carRestorer) restored() (payloads []payload) {
+	restorer.mu.Lock()
+	defer restorer.mu.Unlock()
+	for _, root := range restorer.store.Roots() {
+		payloads = append(payloads, restorer.payloads[root]...)
+	}
+	return
+}
+
+// mergeChunks merges each chunked file name.00000000, name.00000001... in dir into name,
+// and removes the padding files of graphsplit
+func mergeChunks(ctx context.Context, dir string, parallel int) error {
+	var targets, paddings []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if d.Name() == carPaddingFileName {
+			paddings = append(paddings, path)
+		} else if strings.HasSuffix(d.Name(), firstChunkSuffix) {
+			targets = append(targets, strings.TrimSuffix(path, firstChunkSuffix))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if parallel <= 0 {
+		parallel = 1
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []string
+	limit := make(chan struct{}, parallel)
+	for _, target := range targets {
+		limit <- struct{}{}
+		wg.Add(1)
+		go func(target string) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			log.Info("merge to ", target)
+			if err := mergeChunk(ctx, target); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("%s: %v", target, err))
+				mu.Unlock()
+			}
+		}(target)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("merge failed: %s", strings.Join(errs, "; "))
+	}
+	for _, padding := range paddings {
+		if err = removePadding(dir, padding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeChunk appends the chunks of target in order into target, all the chunks must be continuous
+func mergeChunk(ctx context.Context, target string) (err error) {
+	prefix := filepath.Base(target) + "."
+	entries, err := os.ReadDir(filepath.Dir(target))
+	if err != nil {
+		return
+	}
+	count := 0
+	for _, entry := range entries {
+		if index := strings.TrimPrefix(entry.Name(), prefix); index != entry.Name() && isChunkIndex(index) {
+			count++
+		}
+	}
+
+	partPath := target + partSuffix
+	f, err := os.Create(partPath)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(partPath)
+		}
+	}()
+	chunks := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := fmt.Sprintf(chunkSuffixFormat, target, i)
+		in, err := os.Open(chunk)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("chunk %d of %d missing", i, count)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, &contextReader{ctx: ctx, r: in})
+		in.Close()
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(partPath, target); err != nil {
+		return
+	}
+	for _, chunk := range chunks {
+		os.Remove(chunk)
+	}
+	return nil
+}
+
+func isChunkIndex(s string) bool {
+	if len(s) != len(firstChunkSuffix)-1 {
+		return false
+	}
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// removePadding removes the padding file in dir, or the top level directory in dir holding it,
+// which is added by graphsplit only for padding
+func removePadding(dir, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+	top, _, nested := strings.Cut(filepath.ToSlash(rel), "/")
+	if !nested {
+		return os.Remove(path)
+	}
+	return os.RemoveAll(filepath.Join(dir, top))
+}
@@ -0,0 +1,163 @@
+package restore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+)
+
+const (
+	carV2HeaderSize = 40
+	// maxSectionSize bounds a block section of a car, blocks are far smaller
+	maxSectionSize = 32 << 20
+)
+
+// carV2Pragma is the first bytes of a CARv2 file, a CARv1 header of version 2 without roots
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+// dataSection returns the CARv1 data of the car file f and its offset in f,
+// the whole file of CARv1 or the inner CARv1 of CARv2
+func dataSection(f *os.File) (section *io.SectionReader, offset int64, err error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return
+	}
+	pragma := make([]byte, len(carV2Pragma))
+	if _, err = f.ReadAt(pragma, 0); err != nil && err != io.EOF {
+		return
+	}
+	if !bytes.Equal(pragma, carV2Pragma) {
+		return io.NewSectionReader(f, 0, stat.Size()), 0, nil
+	}
+	// characteristics, data offset, data size and index offset
+	header := make([]byte, carV2HeaderSize)
+	if _, err = f.ReadAt(header, int64(len(carV2Pragma))); err != nil {
+		return nil, 0, fmt.Errorf("invalid carv2 header: %w", err)
+	}
+	dataOffset := binary.LittleEndian.Uint64(header[16:24])
+	dataSize := binary.LittleEndian.Uint64(header[24:32])
+	if dataOffset > uint64(stat.Size()) || dataSize > uint64(stat.Size())-dataOffset {
+		return nil, 0, fmt.Errorf("invalid carv2 data offset %d size %d of file size %d", dataOffset, dataSize, stat.Size())
+	}
+	return io.NewSectionReader(f, int64(dataOffset), int64(dataSize)), int64(dataOffset), nil
+}
+
+// ReadRoots returns the roots in the header of the CARv1 or CARv2 file at path
+func ReadRoots(path string) ([]cid.Cid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	section, _, err := dataSection(f)
+	if err != nil {
+		return nil, err
+	}
+	header, err := car.ReadHeader(bufio.NewReader(section))
+	if err != nil {
+		return nil, fmt.Errorf("invalid car header: %w", err)
+	}
+	if header.Version != 1 {
+		return nil, fmt.Errorf("not supported car version %d", header.Version)
+	}
+	if len(header.Roots) == 0 {
+		return nil, errors.New("car without roots")
+	}
+	return header.Roots, nil
+}
+
+// CheckCar reads the sections of all the blocks in the CARv1 or CARv2 file at path and fails if the car
+// is truncated in a section, the block data is not read
+func CheckCar(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	section, _, err := dataSection(f)
+	if err != nil {
+		return err
+	}
+	_, err = scanCar(ctx, section, func(cid.Cid, int64, int) {})
+	return err
+}
+
+// blockRef is where the data of a block is in the car files
+type blockRef struct {
+	file   int
+	offset int64
+	size   int
+}
+
+// scanCar calls fn with the cid and data position of each block in the car data section,
+// the data is not read, it is verified when the block is read
+func scanCar(ctx context.Context, section *io.SectionReader, fn func(c cid.Cid, offset int64, size int)) ([]cid.Cid, error) {
+	br := bufio.NewReader(section)
+	header, err := car.ReadHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("invalid car header: %w", err)
+	}
+	if header.Version != 1 {
+		return nil, fmt.Errorf("not supported car version %d", header.Version)
+	}
+	if len(header.Roots) == 0 {
+		return nil, errors.New("car without roots")
+	}
+	// the position after the header, bytes read ahead by br are not consumed
+	pos, err := section.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	offset := pos - int64(br.Buffered())
+	for {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		length, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return header.Roots, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read section at %d: %w", offset, err)
+		}
+		if length == 0 {
+			// zero padding after the last block
+			return header.Roots, nil
+		}
+		if length > maxSectionSize {
+			return nil, fmt.Errorf("invalid section length %d at %d", length, offset)
+		}
+		n, c, err := cid.CidFromReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("read cid at %d: %w", offset, err)
+		}
+		if uint64(n) > length {
+			return nil, fmt.Errorf("cid %s longer than section at %d", c, offset)
+		}
+		dataOffset := offset + int64(uvarintSize(length)+n)
+		size := int(length) - n
+		next := dataOffset + int64(size)
+		if next > section.Size() {
+			return nil, fmt.Errorf("block %s at %d: %w", c, offset, io.ErrUnexpectedEOF)
+		}
+		fn(c, dataOffset, size)
+		if _, err = section.Seek(next, io.SeekStart); err != nil {
+			return nil, err
+		}
+		br.Reset(section)
+		offset = next
+	}
+}
+
+func uvarintSize(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
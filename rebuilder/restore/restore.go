@@ -0,0 +1,514 @@
+// Package restore rebuilds the UnixFS files and directories from the roots of car files,
+// it works with the cars of graphsplit and of other tools like singularity, boost and lotus client import
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-libipfs/files"
+	_ "github.com/ipfs/go-merkledag" // registers the dag-pb, raw and dag-cbor decoders
+	unixfile "github.com/ipfs/go-unixfs/file"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/multiformats/go-multihash"
+)
+
+var errReadOnly = errors.New("restore dag is read only")
+
+// ErrNotFound is returned when a path is not under the root
+var ErrNotFound = errors.New("path not found")
+
+// MissingBlocksError is returned when blocks under the root are not in the added cars
+type MissingBlocksError struct {
+	Root   cid.Cid
+	Blocks []cid.Cid
+}
+
+const maxListedBlocks = 5
+
+func (e *MissingBlocksError) Error() string {
+	listed := make([]string, 0, maxListedBlocks)
+	for i, c := range e.Blocks {
+		if i == maxListedBlocks {
+			listed = append(listed, "...")
+			break
+		}
+		listed = append(listed, c.String())
+	}
+	return fmt.Sprintf("%d blocks of %s missing: %s", len(e.Blocks), e.Root, strings.Join(listed, ", "))
+}
+
+// Restorer indexes the blocks of the added car files and writes the files of their roots,
+// only the positions of blocks are kept in memory, block data is read from the cars and verified
+// against its cid when needed, each car is kept open until Close, so the car files must be kept until restored
+type Restorer struct {
+	mu     sync.RWMutex
+	files  []*os.File
+	index  map[string]blockRef // keyed by multihash, blocks of the same hash share the data
+	roots  []cid.Cid
+	seen   map[cid.Cid]bool
+	writer func(nd files.Node, path string) error
+}
+
+func NewRestorer() *Restorer {
+	return &Restorer{
+		index: make(map[string]blockRef),
+		seen:  make(map[cid.Cid]bool),
+	}
+}
+
+// WithWriter writes the files by writer instead of the built-in writer, like graphsplit.NodeWriteTo
+func (r *Restorer) WithWriter(writer func(nd files.Node, path string) error) *Restorer {
+	r.writer = writer
+	return r
+}
+
+// Add indexes the blocks of the CARv1 or CARv2 file at path and returns its roots,
+// blocks of a root can be in other cars added before or after
+func (r *Restorer) Add(ctx context.Context, path string) ([]cid.Cid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	section, base, err := dataSection(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	refs := make(map[string]blockRef)
+	roots, err := scanCar(ctx, section, func(c cid.Cid, offset int64, size int) {
+		refs[string(c.Hash())] = blockRef{offset: base + offset, size: size}
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file := len(r.files)
+	r.files = append(r.files, f)
+	for key, ref := range refs {
+		if _, ok := r.index[key]; !ok {
+			ref.file = file
+			r.index[key] = ref
+		}
+	}
+	for _, root := range roots {
+		if !r.seen[root] {
+			r.seen[root] = true
+			r.roots = append(r.roots, root)
+		}
+	}
+	return roots, nil
+}
+
+// Roots returns the roots of the added cars in the order added
+func (r *Restorer) Roots() []cid.Cid {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]cid.Cid(nil), r.roots...)
+}
+
+// Has returns whether the block of c is in the added cars
+func (r *Restorer) Has(c cid.Cid) bool {
+	if c.Prefix().MhType == multihash.IDENTITY {
+		return true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.index[string(c.Hash())]
+	return ok
+}
+
+// Block returns the data of the block of c read from the added cars, verified against c
+func (r *Restorer) Block(c cid.Cid) ([]byte, error) {
+	if c.Prefix().MhType == multihash.IDENTITY {
+		decoded, err := multihash.Decode(c.Hash())
+		if err != nil {
+			return nil, err
+		}
+		return decoded.Digest, nil
+	}
+	r.mu.RLock()
+	ref, ok := r.index[string(c.Hash())]
+	var f *os.File
+	if ok {
+		f = r.files[ref.file]
+	}
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	data := make([]byte, ref.size)
+	if _, err := f.ReadAt(data, ref.offset); err != nil {
+		return nil, fmt.Errorf("read block %s from %s: %w", c, f.Name(), err)
+	}
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, fmt.Errorf("block %s in %s hash mismatch, got %s", c, f.Name(), sum)
+	}
+	return data, nil
+}
+
+// Close closes the added car files, blocks can not be read after it
+func (r *Restorer) Close() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.files {
+		if e := f.Close(); e != nil {
+			err = e
+		}
+	}
+	r.files = nil
+	r.index = make(map[string]blockRef)
+	return
+}
+
+// Missing walks the dag of root and returns the blocks not in the added cars
+func (r *Restorer) Missing(ctx context.Context, root cid.Cid) (missing []cid.Cid, err error) {
+	dag := r.DAG()
+	seen := cid.NewSet()
+	stack := []cid.Cid{root}
+	for len(stack) > 0 {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !seen.Visit(c) {
+			continue
+		}
+		if !r.Has(c) {
+			missing = append(missing, c)
+			continue
+		}
+		if c.Type() == cid.Raw {
+			// raw blocks have no links
+			continue
+		}
+		nd, err := dag.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range nd.Links() {
+			stack = append(stack, link.Cid)
+		}
+	}
+	return
+}
+
+// WriteTo writes the UnixFS file or directory of root into dir, the entries of a directory root
+// are written into dir with their names, a file root is written to dir/<root cid>. The dag is walked
+// once while writing, a *MissingBlocksError is returned if a block under root is not in the added cars,
+// the files written before it are left for the root to be written again
+func (r *Restorer) WriteTo(ctx context.Context, root cid.Cid, dir string) error {
+	dag := r.DAG()
+	nd, err := dag.Get(ctx, root)
+	if err != nil {
+		return r.missingError(ctx, root, root, err)
+	}
+	node, err := unixfile.NewUnixfsFile(ctx, dag, nd)
+	if err != nil {
+		return r.missingError(ctx, root, root, fmt.Errorf("root %s is not unixfs: %w", root, err))
+	}
+	defer node.Close()
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if _, ok := node.(files.Directory); ok {
+		err = r.write(ctx, node, dir, "")
+	} else {
+		err = r.write(ctx, node, dir, root.String())
+	}
+	return r.missingError(ctx, root, root, err)
+}
+
+// missingError returns the *MissingBlocksError of root listing the blocks missing under c if err is caused
+// by a missing block, otherwise err, the dag of c is only walked again on the missing block
+func (r *Restorer) missingError(ctx context.Context, root, c cid.Cid, err error) error {
+	if !ipld.IsNotFound(err) {
+		return err
+	}
+	missing, e := r.Missing(ctx, c)
+	if e != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		var notFound ipld.ErrNotFound
+		if !errors.As(err, &notFound) {
+			return err
+		}
+		missing = []cid.Cid{notFound.Cid}
+	}
+	return &MissingBlocksError{Root: root, Blocks: missing}
+}
+
+// write writes nd at rel under the output directory root by the writer, or by the built-in one if not set
+func (r *Restorer) write(ctx context.Context, nd files.Node, root, rel string) error {
+	if r.writer != nil {
+		return r.writer(nd, filepath.Join(root, rel))
+	}
+	return writeNode(ctx, nd, root, rel)
+}
+
+// Resolve returns the node of the slash separated UnixFS path under root, the root itself if path is empty,
+// only the blocks of the directories on the path are needed
+func (r *Restorer) Resolve(ctx context.Context, root cid.Cid, path string) (ipld.Node, error) {
+	dag := r.DAG()
+	nd, err := dag.Get(ctx, root)
+	for _, name := range strings.Split(path, "/") {
+		if err != nil || name == "" {
+			break
+		}
+		var dir uio.Directory
+		if dir, err = uio.NewDirectoryFromNode(dag, nd); err != nil {
+			if errors.Is(err, uio.ErrNotADir) {
+				err = fmt.Errorf("%s of %s: %w", path, root, ErrNotFound)
+			}
+			break
+		}
+		if nd, err = dir.Find(ctx, name); errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("%s of %s: %w", path, root, ErrNotFound)
+		}
+	}
+	var notFound ipld.ErrNotFound
+	if errors.As(err, &notFound) {
+		return nil, &MissingBlocksError{Root: root, Blocks: []cid.Cid{notFound.Cid}}
+	}
+	return nd, err
+}
+
+// Entries returns the names of the entries in the directory at path under root
+func (r *Restorer) Entries(ctx context.Context, root cid.Cid, path string) (names []string, err error) {
+	nd, err := r.Resolve(ctx, root, path)
+	if err != nil {
+		return
+	}
+	dir, err := uio.NewDirectoryFromNode(r.DAG(), nd)
+	if errors.Is(err, uio.ErrNotADir) {
+		return nil, fmt.Errorf("%s of %s is not a directory: %w", path, root, ErrNotFound)
+	}
+	if err != nil {
+		return
+	}
+	err = dir.ForEachLink(ctx, func(link *ipld.Link) error {
+		names = append(names, link.Name)
+		return nil
+	})
+	var notFound ipld.ErrNotFound
+	if errors.As(err, &notFound) {
+		return nil, &MissingBlocksError{Root: root, Blocks: []cid.Cid{notFound.Cid}}
+	}
+	return
+}
+
+// WritePath writes the UnixFS file or directory at the slash separated path under root to the same path in dir
+// and returns its cid, only the blocks on the path and under it are needed
+func (r *Restorer) WritePath(ctx context.Context, root cid.Cid, path, dir string) (cid.Cid, error) {
+	for _, name := range strings.Split(path, "/") {
+		if !validName(name) {
+			return cid.Undef, fmt.Errorf("invalid path %q", path)
+		}
+	}
+	nd, err := r.Resolve(ctx, root, path)
+	if err != nil {
+		return cid.Undef, err
+	}
+	node, err := unixfile.NewUnixfsFile(ctx, r.DAG(), nd)
+	if err != nil {
+		return cid.Undef, r.missingError(ctx, root, nd.Cid(), fmt.Errorf("%s of %s is not unixfs: %w", path, root, err))
+	}
+	defer node.Close()
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return cid.Undef, err
+	}
+	rel := filepath.FromSlash(path)
+	if err = mkdirs(dir, filepath.Dir(rel)); err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), r.missingError(ctx, root, nd.Cid(), r.write(ctx, node, dir, rel))
+}
+
+// writeNode writes nd at rel under the output directory root, directories are merged with the existing ones,
+// the existing symlinks under root are never followed and the symlinks written never point out of root
+func writeNode(ctx context.Context, nd files.Node, root, rel string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := filepath.Join(root, rel)
+	switch nd := nd.(type) {
+	case *files.Symlink:
+		if !validTarget(rel, nd.Target) {
+			return fmt.Errorf("symlink %s target %q out of the output directory", rel, nd.Target)
+		}
+		if target, err := os.Readlink(path); err == nil && target == nd.Target {
+			return nil
+		}
+		return os.Symlink(nd.Target, path)
+	case files.File:
+		if stat, err := os.Lstat(path); err == nil && !stat.Mode().IsRegular() {
+			return fmt.Errorf("write %s: existing %s is not a regular file", path, stat.Mode().Type())
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, nd)
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return fmt.Errorf("write %s: %w", path, err)
+		}
+		return nil
+	case files.Directory:
+		if rel != "" {
+			if err := mkdir(path); err != nil {
+				return err
+			}
+		}
+		entries := nd.Entries()
+		for entries.Next() {
+			name := entries.Name()
+			if !validName(name) {
+				return fmt.Errorf("invalid entry name %q in %s", name, path)
+			}
+			if err := writeNode(ctx, entries.Node(), root, filepath.Join(rel, name)); err != nil {
+				return err
+			}
+		}
+		return entries.Err()
+	default:
+		return fmt.Errorf("not supported node %T at %s", nd, path)
+	}
+}
+
+// mkdirs creates the directories of rel under root one by one, an existing symlink on the way is an error
+func mkdirs(root, rel string) error {
+	path := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if name == "" || name == "." {
+			continue
+		}
+		path = filepath.Join(path, name)
+		if err := mkdir(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdir creates the directory at path unless it exists, an existing symlink or file at path is an error
+func mkdir(path string) error {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		if err = os.Mkdir(path, 0755); os.IsExist(err) {
+			return mkdir(path)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("create directory %s: existing %s is not a directory", path, stat.Mode().Type())
+	}
+	return nil
+}
+
+// validTarget rejects the absolute symlink targets and the relative ones out of the output directory from the symlink at rel,
+// ".." is only allowed at the start of target, so it never climbs back through a symlink
+func validTarget(rel, target string) bool {
+	if target == "" || filepath.IsAbs(target) || filepath.VolumeName(target) != "" || strings.HasPrefix(target, "/") || strings.HasPrefix(target, `\`) {
+		return false
+	}
+	depth := 0
+	if dir := filepath.Dir(rel); dir != "." {
+		depth = len(strings.Split(dir, string(filepath.Separator)))
+	}
+	named := false
+	for _, name := range strings.FieldsFunc(target, func(r rune) bool { return r == '/' || r == '\\' }) {
+		switch {
+		case name == ".":
+		case name == "..":
+			if named || depth == 0 {
+				return false
+			}
+			depth--
+		default:
+			named = true
+		}
+	}
+	return true
+}
+
+// validName rejects the entry names escaping the directory
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// DAG returns the read only dag service of the blocks in the added cars
+func (r *Restorer) DAG() ipld.DAGService {
+	return &dagService{r}
+}
+
+type dagService struct {
+	r *Restorer
+}
+
+func (s *dagService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	data, err := s.r.Block(c)
+	if err != nil {
+		return nil, err
+	}
+	block, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, err
+	}
+	return ipld.Decode(block)
+}
+
+func (s *dagService) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		for _, c := range cids {
+			nd, err := s.Get(ctx, c)
+			select {
+			case out <- &ipld.NodeOption{Node: nd, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (s *dagService) Add(context.Context, ipld.Node) error {
+	return errReadOnly
+}
+
+func (s *dagService) AddMany(context.Context, []ipld.Node) error {
+	return errReadOnly
+}
+
+func (s *dagService) Remove(context.Context, cid.Cid) error {
+	return errReadOnly
+}
+
+func (s *dagService) RemoveMany(context.Context, []cid.Cid) error {
+	return errReadOnly
+}
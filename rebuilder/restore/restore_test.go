@@ -0,0 +1,321 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	"github.com/ipfs/go-unixfs/importer/helpers"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+)
+
+// memDAG keeps the nodes of the test dags in the order added
+type memDAG struct {
+	nodes map[cid.Cid]ipld.Node
+	order []cid.Cid
+}
+
+func newMemDAG() *memDAG {
+	return &memDAG{nodes: make(map[cid.Cid]ipld.Node)}
+}
+
+func (dag *memDAG) Get(_ context.Context, c cid.Cid) (ipld.Node, error) {
+	if nd, ok := dag.nodes[c]; ok {
+		return nd, nil
+	}
+	return nil, ipld.ErrNotFound{Cid: c}
+}
+
+func (dag *memDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	for _, c := range cids {
+		nd, err := dag.Get(ctx, c)
+		out <- &ipld.NodeOption{Node: nd, Err: err}
+	}
+	close(out)
+	return out
+}
+
+func (dag *memDAG) Add(_ context.Context, nd ipld.Node) error {
+	if _, ok := dag.nodes[nd.Cid()]; !ok {
+		dag.nodes[nd.Cid()] = nd
+		dag.order = append(dag.order, nd.Cid())
+	}
+	return nil
+}
+
+func (dag *memDAG) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		dag.Add(ctx, nd)
+	}
+	return nil
+}
+
+func (dag *memDAG) Remove(context.Context, cid.Cid) error {
+	return errReadOnly
+}
+
+func (dag *memDAG) RemoveMany(context.Context, []cid.Cid) error {
+	return errReadOnly
+}
+
+func (dag *memDAG) file(data string) ipld.Node {
+	nd := merkledag.NodeWithData(unixfs.FilePBData([]byte(data), uint64(len(data))))
+	dag.Add(context.Background(), nd)
+	return nd
+}
+
+// chunked adds the file of data chunked by size with raw leaves
+func (dag *memDAG) chunked(t *testing.T, data []byte, size int64) ipld.Node {
+	t.Helper()
+	params := helpers.DagBuilderParams{Maxlinks: helpers.DefaultLinksPerBlock, RawLeaves: true, Dagserv: dag}
+	db, err := params.New(chunker.NewSizeSplitter(bytes.NewReader(data), size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := balanced.Layout(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nd
+}
+
+func (dag *memDAG) symlink(t *testing.T, target string) ipld.Node {
+	t.Helper()
+	data, err := unixfs.SymlinkData(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd := merkledag.NodeWithData(data)
+	dag.Add(context.Background(), nd)
+	return nd
+}
+
+func (dag *memDAG) dir(t *testing.T, entries map[string]ipld.Node) ipld.Node {
+	t.Helper()
+	ctx := context.Background()
+	dir := uio.NewDirectory(dag)
+	for name, nd := range entries {
+		if err := dir.AddChild(ctx, name, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dag.Add(ctx, nd)
+	return nd
+}
+
+// writeCar writes the CARv1 of root with the nodes of dag at path, the nodes in skip are left out
+func (dag *memDAG) writeCar(t *testing.T, path string, root cid.Cid, skip ...cid.Cid) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	skipped := cid.NewSet()
+	for _, c := range skip {
+		skipped.Add(c)
+	}
+	for _, c := range dag.order {
+		if skipped.Has(c) {
+			continue
+		}
+		if err := util.LdWrite(&buf, c.Bytes(), dag.nodes[c].RawData()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// restoreCar adds the car of root in dag to a new restorer and writes root into output
+func restoreCar(t *testing.T, dag *memDAG, root ipld.Node, output string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "root.car")
+	dag.writeCar(t, path, root.Cid())
+	r := NewRestorer()
+	t.Cleanup(func() { r.Close() })
+	if _, err := r.Add(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	return r.WriteTo(context.Background(), root.Cid(), output)
+}
+
+func TestWriteSymlinks(t *testing.T) {
+	rejected := []struct {
+		name   string
+		target string
+		nested bool
+	}{
+		{"absolute", "/etc/passwd", false},
+		{"parent", "../outside", false},
+		{"nested parent", "../../outside", true},
+		{"through named", "sub/../..", true},
+		{"backslash parent", `..\outside`, false},
+	}
+	for _, tc := range rejected {
+		t.Run(tc.name, func(t *testing.T) {
+			dag := newMemDAG()
+			root := dag.dir(t, map[string]ipld.Node{"link": dag.symlink(t, tc.target)})
+			if tc.nested {
+				root = dag.dir(t, map[string]ipld.Node{"sub": root})
+			}
+			output := t.TempDir()
+			err := restoreCar(t, dag, root, output)
+			if err == nil || !strings.Contains(err.Error(), "out of the output directory") {
+				t.Fatalf("symlink to %s written: %v", tc.target, err)
+			}
+		})
+	}
+
+	dag := newMemDAG()
+	sub := dag.dir(t, map[string]ipld.Node{
+		"up":   dag.symlink(t, "../a.txt"),
+		"same": dag.symlink(t, "./b/../c"),
+	})
+	root := dag.dir(t, map[string]ipld.Node{"a.txt": dag.file("a"), "sub": sub})
+	output := t.TempDir()
+	if err := restoreCar(t, dag, root, output); err == nil || !strings.Contains(err.Error(), "./b/../c") {
+		t.Fatalf("symlink climbing through a name written: %v", err)
+	}
+
+	dag = newMemDAG()
+	sub = dag.dir(t, map[string]ipld.Node{"up": dag.symlink(t, "../a.txt")})
+	root = dag.dir(t, map[string]ipld.Node{"a.txt": dag.file("a"), "sub": sub})
+	output = t.TempDir()
+	if err := restoreCar(t, dag, root, output); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(output, "sub", "up")); err != nil || string(data) != "a" {
+		t.Fatalf("read through restored symlink: %q %v", data, err)
+	}
+	// restoring again keeps the same symlink
+	if err := restoreCar(t, dag, root, output); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteNotFollowExistingSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	dag := newMemDAG()
+	sub := dag.dir(t, map[string]ipld.Node{"a.txt": dag.file("a")})
+	root := dag.dir(t, map[string]ipld.Node{"sub": sub, "b.txt": dag.file("b")})
+
+	output := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(output, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreCar(t, dag, root, output); err == nil {
+		t.Fatal("wrote into the existing symlink to a directory")
+	}
+
+	output = t.TempDir()
+	if err := os.Symlink(filepath.Join(outside, "b.txt"), filepath.Join(output, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreCar(t, dag, root, output); err == nil {
+		t.Fatal("wrote through the existing symlink to a file")
+	}
+
+	path := filepath.Join(t.TempDir(), "root.car")
+	dag.writeCar(t, path, root.Cid())
+	r := NewRestorer()
+	t.Cleanup(func() { r.Close() })
+	if _, err := r.Add(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	output = t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(output, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.WritePath(context.Background(), root.Cid(), "sub/a.txt", output); err == nil {
+		t.Fatal("wrote the path into the existing symlink to a directory")
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Fatalf("%d files written out of the output directory", len(entries))
+	}
+}
+
+func TestWriteMissingBlocks(t *testing.T) {
+	ctx := context.Background()
+	dag := newMemDAG()
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	file := dag.chunked(t, data, 100)
+	sub := dag.dir(t, map[string]ipld.Node{"c.txt": dag.file("c")})
+	root := dag.dir(t, map[string]ipld.Node{"a.bin": file, "sub": sub})
+	leaf := file.Links()[3].Cid
+
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.car"), filepath.Join(dir, "second.car")
+	dag.writeCar(t, first, root.Cid(), leaf, sub.Cid())
+	rest := newMemDAG()
+	rest.Add(ctx, dag.nodes[leaf])
+	rest.Add(ctx, sub)
+	rest.writeCar(t, second, root.Cid())
+
+	r := NewRestorer()
+	defer r.Close()
+	if _, err := r.Add(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	output := t.TempDir()
+	err := r.WriteTo(ctx, root.Cid(), output)
+	var missingErr *MissingBlocksError
+	if !errors.As(err, &missingErr) {
+		t.Fatalf("write with missing blocks: %v", err)
+	}
+	missing := cid.NewSet()
+	for _, c := range missingErr.Blocks {
+		missing.Add(c)
+	}
+	if missing.Len() != 2 || !missing.Has(leaf) || !missing.Has(sub.Cid()) || !missingErr.Root.Equals(root.Cid()) {
+		t.Fatalf("missing blocks %v of %s, want %s and %s", missingErr.Blocks, missingErr.Root, leaf, sub.Cid())
+	}
+	if _, err = r.WritePath(ctx, root.Cid(), "a.bin", output); !errors.As(err, &missingErr) || len(missingErr.Blocks) != 1 {
+		t.Fatalf("write path with missing blocks: %v", err)
+	}
+
+	if _, err = r.Add(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.WriteTo(ctx, root.Cid(), output); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(output, "a.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("restored a.bin not matched: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(output, "sub", "c.txt")); err != nil || string(got) != "c" {
+		t.Fatalf("restored sub/c.txt not matched: %q %v", got, err)
+	}
+
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Block(leaf); err == nil {
+		t.Fatal("read block after close")
+	}
+}
@@ -0,0 +1,45 @@
+package rebuilder
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+)
+
+// restoreByName restores the car of the test payload in a car directory by the restorer registered as name
+func restoreByName(t *testing.T, name string) {
+	dag, root, files := testPayload(t)
+	carDir, output := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(carDir, "payload.car"), carData(t, dag, root.Cid(), nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, restorer, _, err := newStages(&config.Config{Task: &config.Task{Restorer: name, Sink: SinkNone, Fetcher: "http"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := &Pipeline{Source: carDirSource{}, Restorer: restorer, Sink: noneSink{}}
+	if _, err = pipeline.Run(context.Background(), &Job{CarDir: carDir, OutputDir: output}); err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range files {
+		got, err := os.ReadFile(filepath.Join(output, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("restored %s not matched", rel)
+		}
+	}
+}
+
+func TestRestoreUnixFS(t *testing.T) {
+	restoreByName(t, RestorerUnixFS)
+}
+
+func TestRestoreGraphsplit(t *testing.T) {
+	restoreByName(t, RestorerGraphsplit)
+}
@@ -0,0 +1,121 @@
+package rebuilder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/lotus"
+)
+
+// retrieveSource retrieves the cars of the payload cids of the job from their deals by lotus,
+// the ongoing retrieval deal is canceled when ctx is canceled. If the path to rebuild is set, only the subtree
+// of the path is retrieved from the cars in the graphsplit manifest, and the cars without the path are skipped
+type retrieveSource struct {
+	client *lotus.Client
+	wallet string
+	path   string
+	graph  GraphManifest
+}
+
+// newRetrieveSource returns the source retrieving by the lotus of conf with the wallet of conf
+func newRetrieveSource(conf *config.Config) (Source, error) {
+	if conf.Lotus == nil {
+		return nil, errors.New("conf not set lotus")
+	}
+	source := &retrieveSource{wallet: conf.Lotus.Wallet, path: cleanDataPath(conf.Task.Path)}
+	if conf.Task.GraphManifest != "" {
+		graph, err := ReadGraphManifest(conf.Task.GraphManifest)
+		if err != nil {
+			return nil, err
+		}
+		source.graph = graph
+	}
+	client, err := lotus.NewClient(conf.Lotus.NodeApi, conf.Lotus.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	source.client = client
+	return source, nil
+}
+
+// Close closes the lotus client
+func (source *retrieveSource) Close() error {
+	return source.client.Close()
+}
+
+// Cars retrieves the car of each payload cid of job.Cars into job.CarDir from its deals in order
+func (source *retrieveSource) Cars(ctx context.Context, job *Job, found func(path string)) error {
+	if len(job.Cars) == 0 {
+		return errors.New("invalid empty carInfos")
+	}
+	retrieved := 0
+	for _, info := range job.Cars {
+		if info.CID == "" || len(info.Deals) == 0 {
+			return errors.New("invalid empty cid or miners")
+		}
+		selector, ok := source.selector(info.CID)
+		if !ok {
+			log.Infof("skip retrieve file %s without %s", info.CID, source.path)
+			continue
+		}
+		var path string
+		var err error
+		for _, deal := range info.Deals {
+			cid, miner := info.CID, deal.MinerFid
+			if path, err = source.retrieveFile(ctx, job, cid, miner, selector); err == nil {
+				log.Infof("retrieve file %s with miner :%s success\n", cid, miner)
+				break
+			}
+			log.Errorf("retrieve file %s with miner :%s failed: %v\n", cid, miner, err)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		if err != nil {
+			log.Errorf("retrieve file %s with all miners failed: %v\n", info.CID, err)
+			return fmt.Errorf("retrieve failed with file :%s", info.CID)
+		}
+		found(path)
+		retrieved++
+	}
+	if retrieved == 0 {
+		return fmt.Errorf("%s not found in graph manifest", source.path)
+	}
+	return nil
+}
+
+// selector returns the datamodel path selector to retrieve the path to rebuild from the car of payloadCid,
+// empty to retrieve the whole car if the path is not set, the car is not in the graphsplit manifest or holds
+// more than one entry of the path, false if the car does not hold the path
+func (source *retrieveSource) selector(payloadCid string) (string, bool) {
+	node, ok := source.graph[payloadCid]
+	if source.path == "" || !ok {
+		return "", true
+	}
+	selectors := node.selectors(source.path)
+	if len(selectors) == 1 {
+		return selectors[0], true
+	}
+	return "", len(selectors) > 0
+}
+
+// retrieveFile retrieves the car of cid from miner into job.CarDir, only the subtree matched by selector if not empty
+func (source *retrieveSource) retrieveFile(ctx context.Context, job *Job, cid, miner, selector string) (path string, err error) {
+	if cid == "" || miner == "" {
+		return "", errors.New("invalid empty cid or miner")
+	}
+	path = filepath.Join(job.CarDir, fmt.Sprintf("%s-%s.car", miner, cid))
+	name := miner + "/" + cid
+	meter := new(speedometer)
+	err = source.client.RetrievePath(ctx, miner, cid, selector, path, source.wallet, func(received, total uint64) {
+		p := Progress{Stage: StageRetrieve, Job: name, Done: int64(received), Total: int64(total)}
+		meter.update(&p)
+		job.report(p)
+	})
+	job.report(Progress{Stage: StageRetrieve, Job: name, Finished: true, Err: err})
+	return
+}
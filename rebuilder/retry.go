@@ -0,0 +1,97 @@
+package rebuilder
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/aria2"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+)
+
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 5 * time.Second
+	defaultRetryMaxBackoff = time.Minute
+)
+
+// aria2 exit status codes worth retrying:
+// unknown error, timeout, too slow, network problem, name resolution failed, bad http response, server overloaded
+var defaultRetryAria2Codes = []int{1, 2, 5, 6, 19, 22, 29}
+
+// RetryPolicy controls how many times a failed download is tried and how long to wait between tries
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Aria2Codes map[int]bool
+}
+
+func DefaultRetryPolicy() *RetryPolicy {
+	return NewRetryPolicy(nil)
+}
+
+// NewRetryPolicy creates policy from conf, unset fields use the default value
+func NewRetryPolicy(conf *config.Retry) *RetryPolicy {
+	policy := &RetryPolicy{
+		Attempts:   defaultRetryAttempts,
+		Backoff:    defaultRetryBackoff,
+		MaxBackoff: defaultRetryMaxBackoff,
+		Aria2Codes: make(map[int]bool),
+	}
+	codes := defaultRetryAria2Codes
+	if conf != nil {
+		if conf.Attempts > 0 {
+			policy.Attempts = conf.Attempts
+		}
+		if conf.Backoff > 0 {
+			policy.Backoff = time.Duration(conf.Backoff) * time.Second
+		}
+		if conf.MaxBackoff > 0 {
+			policy.MaxBackoff = time.Duration(conf.MaxBackoff) * time.Second
+		}
+		if len(conf.Aria2Codes) > 0 {
+			codes = conf.Aria2Codes
+		}
+	}
+	for _, code := range codes {
+		policy.Aria2Codes[code] = true
+	}
+	return policy
+}
+
+// Retryable reports whether err is temporary, other errors than aria2/http status errors are retryable
+func (policy *RetryPolicy) Retryable(err error) bool {
+	var downloadErr *aria2.DownloadError
+	if errors.As(err, &downloadErr) {
+		return policy.Aria2Codes[downloadErr.Code]
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+	var noS3Err *noS3Error
+	if errors.As(err, &noS3Err) {
+		return false
+	}
+	var notLocalErr *notLocalError
+	if errors.As(err, &notLocalErr) {
+		return false
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	return true
+}
+
+// Delay returns the exponential backoff before the next try after attempt tries failed
+func (policy *RetryPolicy) Delay(attempt int) time.Duration {
+	delay := policy.Backoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= policy.MaxBackoff {
+			return policy.MaxBackoff
+		}
+	}
+	return delay
+}
@@ -0,0 +1,91 @@
+package rebuilder
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/aria2"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		conf       *config.Retry
+		attempts   int
+		backoff    time.Duration
+		maxBackoff time.Duration
+		codes      []int
+	}{
+		{"default", nil, defaultRetryAttempts, defaultRetryBackoff, defaultRetryMaxBackoff, defaultRetryAria2Codes},
+		{"unset fields default", &config.Retry{Attempts: 5}, 5, defaultRetryBackoff, defaultRetryMaxBackoff, defaultRetryAria2Codes},
+		{"all set", &config.Retry{Attempts: 1, Backoff: 2, MaxBackoff: 10, Aria2Codes: []int{3}}, 1, 2 * time.Second, 10 * time.Second, []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := NewRetryPolicy(tt.conf)
+			if policy.Attempts != tt.attempts || policy.Backoff != tt.backoff || policy.MaxBackoff != tt.maxBackoff {
+				t.Fatalf("policy %+v, want attempts %d backoff %s max backoff %s", policy, tt.attempts, tt.backoff, tt.maxBackoff)
+			}
+			if len(policy.Aria2Codes) != len(tt.codes) {
+				t.Fatalf("aria2 codes %v, want %v", policy.Aria2Codes, tt.codes)
+			}
+			for _, code := range tt.codes {
+				if !policy.Aria2Codes[code] {
+					t.Fatalf("aria2 code %d not retried", code)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := &RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{100, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempt), func(t *testing.T) {
+			if got := policy.Delay(tt.attempt); got != tt.want {
+				t.Fatalf("delay %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"other", errors.New("connection reset"), true},
+		{"aria2 timeout", &aria2.DownloadError{Code: 2}, true},
+		{"aria2 not found", &aria2.DownloadError{Code: 3}, false},
+		{"wrapped aria2", fmt.Errorf("download: %w", &aria2.DownloadError{Code: 6}), true},
+		{"http 503", &HTTPStatusError{Code: 503}, true},
+		{"http 429", &HTTPStatusError{Code: 429}, true},
+		{"http 404", &HTTPStatusError{Code: 404}, false},
+		{"no s3", &noS3Error{URL: "s3://bucket/a.car"}, false},
+		{"not local", &notLocalError{URL: "file://host/a.car"}, false},
+		{"not exist", fmt.Errorf("open a.car: %w", fs.ErrNotExist), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Retryable(tt.err); got != tt.want {
+				t.Fatalf("retryable %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
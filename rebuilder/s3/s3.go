@@ -0,0 +1,335 @@
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Scheme = "s3://"
+
+	defaultRegion    = "us-east-1"
+	algorithm        = "AWS4-HMAC-SHA256"
+	service          = "s3"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	timeFormat       = "20060102T150405Z"
+	dateFormat       = "20060102"
+	maxPresignExpiry = 7 * 24 * time.Hour
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Config is the endpoint and credentials of S3 compatible storage, empty keys are read from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+type Config struct {
+	Endpoint     string // like http://127.0.0.1:9000, default https://s3.<region>.amazonaws.com
+	Region       string // default us-east-1
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	PathStyle    bool // bucket in path instead of host, required by most S3 compatible storage
+}
+
+type Client struct {
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	pathStyle bool
+	client    *http.Client
+	now       func() time.Time
+}
+
+type Object struct {
+	Key  string
+	Size int64
+	ETag string
+}
+
+func NewClient(conf *Config) (*Client, error) {
+	if conf == nil {
+		conf = new(Config)
+	}
+	region := conf.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	endpoint := conf.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	u, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", endpoint)
+	}
+	client := &Client{
+		endpoint:  u,
+		region:    region,
+		accessKey: conf.AccessKey,
+		secretKey: conf.SecretKey,
+		token:     conf.SessionToken,
+		pathStyle: conf.PathStyle,
+		client:    &http.Client{},
+		now:       time.Now,
+	}
+	if client.accessKey == "" && client.secretKey == "" {
+		client.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		client.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		client.token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if client.accessKey == "" || client.secretKey == "" {
+		return nil, errors.New("s3 access key and secret key not set")
+	}
+	return client, nil
+}
+
+// ParseURL returns the bucket and key of s3://bucket/key, ok is false if not a s3 url
+func ParseURL(s3URL string) (bucket, key string, ok bool) {
+	if !strings.HasPrefix(s3URL, Scheme) {
+		return
+	}
+	bucket, key, _ = strings.Cut(strings.TrimPrefix(s3URL, Scheme), "/")
+	return bucket, key, bucket != ""
+}
+
+// objectURL returns the url of the object with virtual hosted or path style
+func (c *Client) objectURL(bucket, key string) *url.URL {
+	u := *c.endpoint
+	path := "/" + key
+	if c.pathStyle {
+		path = "/" + bucket + path
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	u.Path = u.Path + path
+	u.RawPath = escapePath(u.Path)
+	return &u
+}
+
+// escapePath escapes each segment of path by RFC 3986 as the canonical uri of S3
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Presign returns a GET url of the object signed with query parameters, valid for expires
+func (c *Client) Presign(bucket, key string, expires time.Duration) (string, error) {
+	if expires <= 0 || expires > maxPresignExpiry {
+		return "", fmt.Errorf("invalid presign expires: %s", expires)
+	}
+	u := c.objectURL(bucket, key)
+	now := c.now().UTC()
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", algorithm)
+	query.Set("X-Amz-Credential", c.accessKey+"/"+c.scope(now))
+	query.Set("X-Amz-Date", now.Format(timeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if c.token != "" {
+		query.Set("X-Amz-Security-Token", c.token)
+	}
+	header := http.Header{}
+	header.Set("Host", u.Host)
+	signature := c.signature(now, http.MethodGet, u.EscapedPath(), query, header, unsignedPayload)
+	query.Set("X-Amz-Signature", signature)
+	u.RawQuery = canonicalQuery(query)
+	return u.String(), nil
+}
+
+type listResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+		ETag string `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns all the objects of the bucket with the key prefix
+func (c *Client) List(ctx context.Context, bucket, prefix string) (objects []*Object, err error) {
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var result listResult
+		if err = c.get(ctx, bucket, "", query, &result); err != nil {
+			return
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, &Object{Key: content.Key, Size: content.Size, ETag: strings.Trim(content.ETag, `"`)})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// get sends a GET request signed by headers and decodes the xml response into result
+func (c *Client) get(ctx context.Context, bucket, key string, query url.Values, result interface{}) error {
+	u := c.objectURL(bucket, key)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	c.sign(req, emptyPayloadHash)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		xml.Unmarshal(body, &e)
+		return fmt.Errorf("s3 %s: %s %s %s", u.Redacted(), resp.Status, e.Code, e.Message)
+	}
+	return xml.Unmarshal(body, result)
+}
+
+// sign adds the authorization header of signature v4 to req
+func (c *Client) sign(req *http.Request, payloadHash string) {
+	now := c.now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(timeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+	header := req.Header.Clone()
+	header.Set("Host", req.URL.Host)
+	signature := c.signature(now, req.Method, req.URL.EscapedPath(), req.URL.Query(), header, payloadHash)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, c.accessKey, c.scope(now), signedHeaders(header), signature))
+}
+
+func (c *Client) scope(t time.Time) string {
+	return t.Format(dateFormat) + "/" + c.region + "/" + service + "/aws4_request"
+}
+
+// signature returns the signature v4 of the request, all the header are signed
+func (c *Client) signature(t time.Time, method, path string, query url.Values, header http.Header, payloadHash string) string {
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		canonicalQuery(query),
+		canonicalHeaders(header),
+		signedHeaders(header),
+		payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		algorithm,
+		t.Format(timeFormat),
+		c.scope(t),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), t.Format(dateFormat))
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns the query sorted by key with keys and values escaped by RFC 3986
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaders(header http.Header) string {
+	var b strings.Builder
+	for _, k := range sortedHeaderKeys(header) {
+		values := header.Values(k)
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		b.WriteString(strings.ToLower(k) + ":" + strings.Join(values, ",") + "\n")
+	}
+	return b.String()
+}
+
+func signedHeaders(header http.Header) string {
+	keys := sortedHeaderKeys(header)
+	for i, k := range keys {
+		keys[i] = strings.ToLower(k)
+	}
+	return strings.Join(keys, ";")
+}
+
+func sortedHeaderKeys(header http.Header) []string {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.ToLower(keys[i]) < strings.ToLower(keys[j])
+	})
+	return keys
+}
+
+// escape escapes s by RFC 3986, only unreserved characters are kept
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package rebuilder
+
+import (
+	"context"
+	"errors"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/mcs"
+)
+
+// mcsSink uploads the restored files to the mcs bucket by their paths relative to the output directory,
+// so the files of the same name in different directories are kept apart
+type mcsSink struct {
+	client *mcs.BucketClient
+}
+
+func newMCSSink(conf *config.Config) (Sink, error) {
+	if conf.MCS == nil {
+		return nil, errors.New("conf not set mcs")
+	}
+	client, err := mcs.NewBucketClient(conf.MCS.APIKey, conf.MCS.APIToken, conf.MCS.Network, conf.MCS.BucketName)
+	if err != nil {
+		return nil, err
+	}
+	return &mcsSink{client: client}, nil
+}
+
+func (sink *mcsSink) Upload(ctx context.Context, job *Job, path, rel string) (payloadCid, downloadURL string, err error) {
+	file, err := sink.client.Upload(path, rel, true)
+	if err != nil {
+		return
+	}
+	return file.PayloadCid, file.URL, nil
+}
+
+// noneSink keeps the restored files in the output directory without uploading
+type noneSink struct{}
+
+func (noneSink) Upload(context.Context, *Job, string, string) (string, string, error) {
+	return "", "", nil
+}
@@ -0,0 +1,176 @@
+package rebuilder
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/aria2"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/config"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/log"
+	"github.com/FogMeta/rebuilder-tools/rebuilder/s3"
+)
+
+const defaultAria2Session = "aria2.session"
+
+// downloadSource downloads the cars by the fetcher with retries, the complete cars are verified or reused
+type downloadSource struct {
+	parallel  int
+	fetcher   Fetcher
+	retry     *RetryPolicy
+	keepGoing bool
+	s3Client  *s3.Client
+	localMode string
+	options   *config.Download
+	stop      func() error // stops the fetcher
+}
+
+// newDownloadSource returns the source downloading by fetcher with the download settings of conf
+func newDownloadSource(conf *config.Config, fetcher Fetcher) (*downloadSource, error) {
+	s3Client, err := newS3Client(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &downloadSource{
+		parallel:  taskParallel(conf),
+		fetcher:   fetcher,
+		retry:     NewRetryPolicy(conf.Retry),
+		keepGoing: conf.Task.KeepGoing,
+		s3Client:  s3Client,
+		localMode: conf.Task.LocalMode,
+		options:   conf.Download,
+	}, nil
+}
+
+// newDownloadSourceFromConf returns the source downloading by the fetcher of conf, aria2 by default,
+// the ipfs://<PayloadCid> cars are downloaded from the gateways of conf
+func newDownloadSourceFromConf(conf *config.Config) (source Source, err error) {
+	var fetcher Fetcher
+	var stop func() error
+	switch conf.Task.Fetcher {
+	case "", FetcherAria2:
+		var client *aria2.Client
+		var daemon *aria2.Daemon
+		if client, daemon, err = newAria2Client(conf); err != nil {
+			return
+		}
+		fetcher = NewAria2Fetcher(client).WithOptions(conf.Download)
+		stop = func() (err error) {
+			err = client.Close()
+			if daemon != nil {
+				if e := daemon.Stop(); e != nil {
+					err = e
+				}
+			}
+			return
+		}
+	case FetcherHTTP:
+		fetcher = NewHTTPFetcher(conf.Task.Connections).WithOptions(conf.Download)
+	default:
+		return nil, fmt.Errorf("not supported fetcher: %s", conf.Task.Fetcher)
+	}
+	if gateway := newGatewayFetcher(conf); gateway != nil {
+		// the cars of payload cids without url
+		fetcher = &gatewayRouter{fetcher: fetcher, gateway: gateway}
+	}
+	download, err := newDownloadSource(conf, fetcher)
+	if err != nil {
+		if stop != nil {
+			stop()
+		}
+		return
+	}
+	download.stop = stop
+	return download, nil
+}
+
+// newAria2Client connects to the aria2 of conf, or starts a local one if no aria2 host configured
+func newAria2Client(conf *config.Config) (client *aria2.Client, daemon *aria2.Daemon, err error) {
+	aria2Conf := conf.Aria2
+	if aria2Conf == nil {
+		aria2Conf = new(config.Aria2)
+	}
+	host, port, secret := aria2Conf.Host, aria2Conf.Port, aria2Conf.Secret
+	opts := &aria2.ClientOptions{
+		Scheme:   aria2Conf.Scheme,
+		Path:     aria2Conf.Path,
+		CAFile:   aria2Conf.CAFile,
+		CertFile: aria2Conf.CertFile,
+		KeyFile:  aria2Conf.KeyFile,
+		Insecure: aria2Conf.Insecure,
+	}
+	if host == "" {
+		// no aria2 server configured, start a local one
+		session := aria2Conf.Session
+		if session == "" {
+			session = filepath.Join(conf.Task.InputPath, defaultAria2Session)
+		}
+		daemon, err = aria2.StartDaemon(aria2.DaemonOptions{
+			Bin:     aria2Conf.Bin,
+			Port:    port,
+			Secret:  secret,
+			Session: session,
+			Dir:     conf.Task.InputPath,
+		})
+		if err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				daemon.Stop()
+			}
+		}()
+		host, port, secret = daemon.Host(), daemon.Port(), daemon.Secret()
+		// local aria2c serves plain rpc
+		opts = &aria2.ClientOptions{Scheme: aria2.SchemeHttp}
+		if aria2Conf.Scheme == aria2.SchemeWs || aria2Conf.Scheme == aria2.SchemeWss {
+			opts.Scheme = aria2.SchemeWs
+		}
+	}
+	client, err = aria2.NewClientWithOptions(host, port, secret, opts)
+	if err != nil && (opts.Scheme == aria2.SchemeWs || opts.Scheme == aria2.SchemeWss) {
+		log.Warn("aria2 websocket unavailable, fallback to http: ", err)
+		if opts.Scheme == aria2.SchemeWs {
+			opts.Scheme = aria2.SchemeHttp
+		} else {
+			opts.Scheme = aria2.SchemeHttps
+		}
+		client, err = aria2.NewClientWithOptions(host, port, secret, opts)
+	}
+	return
+}
+
+// newS3Client returns the s3 client of conf, nil if s3 not set
+func newS3Client(conf *config.Config) (*s3.Client, error) {
+	if conf.S3 == nil {
+		return nil, nil
+	}
+	return s3.NewClient(&s3.Config{
+		Endpoint:     conf.S3.Endpoint,
+		Region:       conf.S3.Region,
+		AccessKey:    conf.S3.AccessKey,
+		SecretKey:    conf.S3.SecretKey,
+		SessionToken: conf.S3.SessionToken,
+		PathStyle:    conf.S3.PathStyle,
+	})
+}
+
+// Cars downloads the cars of job into job.CarDir, found is called by the download worker with each car
+// downloaded and verified or reused, in-flight downloads are removed when ctx is canceled
+func (source *downloadSource) Cars(ctx context.Context, job *Job, found func(path string)) error {
+	downloader := NewDownloader(source.parallel, source.fetcher).WithRetry(source.retry).WithKeepGoing(source.keepGoing).
+		WithProgress(job.Progress).WithS3(source.s3Client).WithLocalMode(source.localMode).WithOptions(source.options).
+		WithComplete(func(info *DownloadInfo) {
+			found(info.Path())
+		})
+	_, err := downloader.DownloadCars(ctx, job.CarDir, job.Cars...)
+	return err
+}
+
+// Close closes the aria2 client and stops the local aria2 started by the source
+func (source *downloadSource) Close() error {
+	if source.stop != nil {
+		return source.stop()
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package rebuilder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/FogMeta/rebuilder-tools/rebuilder/restore"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+)
+
+// VerifyError is returned when a downloaded car file does not match its metadata
+type VerifyError struct {
+	Path   string
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verify car %s failed: %s", e.Path, e.Reason)
+}
+
+// VerifyCar checks the car file at path is a valid CARv1 or CARv2, and matches the size, sha256,
+// piece cid and payload cid of info when they are set
+func VerifyCar(path string, info *CarInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.CarFileSize > 0 && stat.Size() != info.CarFileSize {
+		return &VerifyError{path, fmt.Sprintf("size %d not matched %d", stat.Size(), info.CarFileSize)}
+	}
+
+	roots, err := restore.ReadRoots(path)
+	if err != nil {
+		return &VerifyError{path, err.Error()}
+	}
+	if info.CID != "" {
+		payloadCid, err := cid.Parse(info.CID)
+		if err != nil {
+			return fmt.Errorf("invalid payload cid %s: %w", info.CID, err)
+		}
+		found := false
+		for _, root := range roots {
+			if root.Equals(payloadCid) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &VerifyError{path, fmt.Sprintf("roots %v not contain payload cid %s", roots, info.CID)}
+		}
+	}
+
+	if info.CarFileSha256 == "" && info.PieceCid == "" {
+		return nil
+	}
+	var writers []io.Writer
+	var sha hash.Hash
+	if info.CarFileSha256 != "" {
+		sha = sha256.New()
+		writers = append(writers, sha)
+	}
+	var calc *commp.Calc
+	var expectedPieceCid cid.Cid
+	if info.PieceCid != "" {
+		if expectedPieceCid, err = cid.Parse(info.PieceCid); err != nil {
+			return fmt.Errorf("invalid piece cid %s: %w", info.PieceCid, err)
+		}
+		calc = new(commp.Calc)
+		writers = append(writers, calc)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return err
+	}
+	if sha != nil {
+		sum := hex.EncodeToString(sha.Sum(nil))
+		if !strings.EqualFold(sum, info.CarFileSha256) {
+			return &VerifyError{path, fmt.Sprintf("sha256 %s not matched %s", sum, info.CarFileSha256)}
+		}
+	}
+	if calc != nil {
+		digest, _, err := calc.Digest()
+		if err != nil {
+			return err
+		}
+		pieceCid, err := commcid.DataCommitmentV1ToCID(digest)
+		if err != nil {
+			return err
+		}
+		if !pieceCid.Equals(expectedPieceCid) {
+			return &VerifyError{path, fmt.Sprintf("piece cid %s not matched %s", pieceCid, info.PieceCid)}
+		}
+	}
+	return nil
+}